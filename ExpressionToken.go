@@ -9,6 +9,7 @@ type expressionToken struct {
 }
 
 func (it *expressionToken) isOperator() bool {
-	return it.Kind == compareToken || it.Kind == logicalToken ||
-		it.Kind == clauseToken || it.Kind == clauseCloseToken
+	return it.Kind == prefixToken || it.Kind == modifierToken || it.Kind == compareToken || it.Kind == logicalToken ||
+		it.Kind == clauseToken || it.Kind == clauseCloseToken ||
+		it.Kind == functionToken || it.Kind == separatorToken || it.Kind == nestedToken
 }
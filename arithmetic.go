@@ -0,0 +1,260 @@
+package esqb
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// foldModifier computes constant arithmetic such as `10 * 1024` or `"2022-01-01" + 3d`,
+// so that the generators only ever receive the result.
+func foldModifier(left, right expressionToken, symbol string) (expressionToken, error) {
+	op := modifierSymbols[symbol]
+	err := fmt.Errorf("can't apply [%s] to %s and %s", op.String(), left.Kind.String(), right.Kind.String())
+
+	switch {
+	case left.Kind == numericToken && right.Kind == numericToken:
+		// integers stay integers as long as the result is exact, e.g. `10 * 1024` but not `7 / 2`
+		l, lok := left.Value.(int64)
+		r, rok := right.Value.(int64)
+		if lok && rok {
+			result, exact, err := applyInt(op, l, r)
+			if err != nil {
+				return expressionToken{}, err
+			}
+			if exact {
+				return expressionToken{Kind: numericToken, Value: result}, nil
+			}
+		}
+		lf, lok := toFloat(left.Value)
+		rf, rok := toFloat(right.Value)
+		if !lok || !rok {
+			return expressionToken{}, err
+		}
+		result, err := applyFloat(op, lf, rf)
+		if err != nil {
+			return expressionToken{}, err
+		}
+		return expressionToken{Kind: numericToken, Value: result}, nil
+
+	case isQuantity(left.Kind) && left.Kind == right.Kind:
+		l, r := quantityOf(left), quantityOf(right)
+		switch op {
+		case plus:
+			return expressionToken{Kind: left.Kind, Value: quantityValue(left.Kind, l+r)}, nil
+		case minus:
+			return expressionToken{Kind: left.Kind, Value: quantityValue(left.Kind, l-r)}, nil
+		}
+
+	case isQuantity(left.Kind) && right.Kind == numericToken,
+		left.Kind == numericToken && isQuantity(right.Kind):
+		quantity, factor := left, right.Value
+		if left.Kind == numericToken {
+			if op != multiply {
+				return expressionToken{}, err
+			}
+			quantity, factor = right, left.Value
+		}
+		f, ok := toFloat(factor)
+		if !ok {
+			return expressionToken{}, err
+		}
+		switch op {
+		case multiply:
+			return expressionToken{Kind: quantity.Kind, Value: quantityValue(quantity.Kind, int64(float64(quantityOf(quantity))*f))}, nil
+		case divide:
+			if f == 0 {
+				return expressionToken{}, errors.New("division by zero")
+			}
+			return expressionToken{Kind: quantity.Kind, Value: quantityValue(quantity.Kind, int64(float64(quantityOf(quantity))/f))}, nil
+		}
+
+	case left.Kind == timeToken && right.Kind == durationToken:
+		t, d := left.Value.(time.Time), right.Value.(time.Duration)
+		switch op {
+		case plus:
+			return expressionToken{Kind: timeToken, Value: t.Add(d)}, nil
+		case minus:
+			return expressionToken{Kind: timeToken, Value: t.Add(-d)}, nil
+		}
+
+	case left.Kind == dateMathToken && right.Kind == durationToken:
+		// `now - 7d` is the date-math `now-7d`
+		d := right.Value.(time.Duration)
+		if op == minus {
+			d = -d
+		}
+		if op != plus && op != minus {
+			break
+		}
+		amount, err := dateMathAmount(d)
+		if err != nil {
+			return expressionToken{}, err
+		}
+		return expressionToken{Kind: dateMathToken, Value: left.Value.(string) + amount}, nil
+
+	case left.Kind == durationToken && right.Kind == timeToken:
+		if op == plus {
+			return expressionToken{Kind: timeToken, Value: right.Value.(time.Time).Add(left.Value.(time.Duration))}, nil
+		}
+	}
+	return expressionToken{}, err
+}
+
+// dateMathUnits are the date-math units a duration can be written in, from the largest
+var dateMathUnits = []struct {
+	unit     string
+	duration time.Duration
+}{
+	{"d", 24 * time.Hour},
+	{"h", time.Hour},
+	{"m", time.Minute},
+	{"s", time.Second},
+}
+
+// dateMathAmount writes a duration as a signed date-math amount in the largest exact unit, e.g. `-7d`
+func dateMathAmount(d time.Duration) (string, error) {
+	sign := "+"
+	if d < 0 {
+		sign, d = "-", -d
+	}
+	for _, unit := range dateMathUnits {
+		if d%unit.duration == 0 {
+			return fmt.Sprintf("%s%d%s", sign, d/unit.duration, unit.unit), nil
+		}
+	}
+	return "", fmt.Errorf("duration %s is not a whole number of seconds, which date-math can't express", d)
+}
+
+// quantities are durations and sizes, both counted in an int64 of nanoseconds or bytes
+func isQuantity(kind tokenKind) bool {
+	return kind == durationToken || kind == sizeToken
+}
+
+func quantityOf(token expressionToken) int64 {
+	switch v := token.Value.(type) {
+	case time.Duration:
+		return int64(v)
+	case ByteSize:
+		return int64(v)
+	}
+	return 0
+}
+
+func quantityValue(kind tokenKind, amount int64) interface{} {
+	if kind == sizeToken {
+		return ByteSize(amount)
+	}
+	return time.Duration(amount)
+}
+
+// negateOperand computes the prefix `-` of a number, a duration or a size, e.g. `-(3 * 2)` or `-:offset`
+func negateOperand(operand expressionToken) (expressionToken, error) {
+	if operand.Kind != numericToken && !isQuantity(operand.Kind) {
+		return expressionToken{}, fmt.Errorf("can't apply [%s] to %s", negate.String(), operand.Kind.String())
+	}
+	value, err := negateNumber(operand.Value)
+	if err != nil {
+		return expressionToken{}, err
+	}
+	return expressionToken{Kind: operand.Kind, Value: value}, nil
+}
+
+func negateNumber(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case int64:
+		if v == math.MinInt64 {
+			return nil, fmt.Errorf("integer overflow negating %d", v)
+		}
+		return -v, nil
+	case uint64:
+		// -9223372036854775808 is read as the uint64 9223372036854775808 first
+		if v == 1<<63 {
+			return int64(math.MinInt64), nil
+		}
+		return nil, fmt.Errorf("integer overflow negating %d", v)
+	case float64:
+		return -v, nil
+	case time.Duration:
+		return -v, nil
+	case ByteSize:
+		return -v, nil
+	}
+	return nil, fmt.Errorf("can't negate %v", value)
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// applyInt computes integer arithmetic, false if the result isn't an integer.
+// Overflows are errors, since falling back to float64 would silently lose precision.
+func applyInt(op Operator, left, right int64) (int64, bool, error) {
+	overflow := fmt.Errorf("integer overflow in %d %s %d", left, op.String(), right)
+	switch op {
+	case plus:
+		if right > 0 && left > math.MaxInt64-right || right < 0 && left < math.MinInt64-right {
+			return 0, false, overflow
+		}
+		return left + right, true, nil
+	case minus:
+		if right < 0 && left > math.MaxInt64+right || right > 0 && left < math.MinInt64+right {
+			return 0, false, overflow
+		}
+		return left - right, true, nil
+	case multiply:
+		product := left * right
+		if left != 0 && (product/left != right || left == -1 && right == math.MinInt64) {
+			return 0, false, overflow
+		}
+		return product, true, nil
+	case divide:
+		if right == 0 {
+			return 0, false, errors.New("division by zero")
+		}
+		if left%right != 0 {
+			return 0, false, nil
+		}
+		if left == math.MinInt64 && right == -1 {
+			return 0, false, overflow
+		}
+		return left / right, true, nil
+	case modulus:
+		if right == 0 {
+			return 0, false, errors.New("division by zero")
+		}
+		return left % right, true, nil
+	}
+	return 0, false, fmt.Errorf("op [%s] is not an arithmetic operator", op.String())
+}
+
+func applyFloat(op Operator, left, right float64) (float64, error) {
+	switch op {
+	case plus:
+		return left + right, nil
+	case minus:
+		return left - right, nil
+	case multiply:
+		return left * right, nil
+	case divide:
+		if right == 0 {
+			return 0, errors.New("division by zero")
+		}
+		return left / right, nil
+	case modulus:
+		if right == 0 {
+			return 0, errors.New("division by zero")
+		}
+		return math.Mod(left, right), nil
+	}
+	return 0, fmt.Errorf("op [%s] is not an arithmetic operator", op.String())
+}
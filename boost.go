@@ -0,0 +1,26 @@
+package esqb
+
+import (
+	"reflect"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// boostQuery sets the boost of a query, e.g. `title == "login"^3`.
+// Most elastic queries have a `Boost(float64)` method, each returning its own type, so it's called by reflection
+// on a copy, as generators may return the same query for several comparisons.
+// Queries without one, such as exists queries, are wrapped in a bool query carrying the boost.
+func boostQuery(query elastic.Query, boost float64) elastic.Query {
+	original := reflect.ValueOf(query)
+	if original.Kind() != reflect.Ptr || original.IsNil() || original.Elem().Kind() != reflect.Struct {
+		return elastic.NewBoolQuery().Must(query).Boost(boost)
+	}
+	copied := reflect.New(original.Elem().Type())
+	copied.Elem().Set(original.Elem())
+	method := copied.MethodByName("Boost")
+	if method.IsValid() && method.Type().NumIn() == 1 && method.Type().In(0).Kind() == reflect.Float64 {
+		method.Call([]reflect.Value{reflect.ValueOf(boost)})
+		return copied.Interface().(elastic.Query)
+	}
+	return elastic.NewBoolQuery().Must(query).Boost(boost)
+}
@@ -0,0 +1,14 @@
+package esqb
+
+// Comment is a comment of the expression, such as `/* blocklist */` or `# owned by the SOC team`.
+// Start and End are the offsets of the whole comment in the expression, in runes.
+type Comment struct {
+	Text  string
+	Start int
+	End   int
+}
+
+// Comments returns the comments of the expression in order, so that they can be preserved by formatters and editors
+func (it *queryBuilder) Comments() []Comment {
+	return it.comments
+}
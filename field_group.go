@@ -0,0 +1,49 @@
+package esqb
+
+import "github.com/olivere/elastic/v7"
+
+// buildFieldGroupComparison compiles a comparison on a group of fields, such as `(title|body) == "login"`.
+// Each field is compared as on its own, so the group is `title == "login" || body == "login"`,
+// or for negated comparators such as `!=` it is `title != "login" && body != "login"`.
+// Equality on fields generated by MatchQueryGenerators is compiled to a single multi_match query.
+func (it *queryBuilder) buildFieldGroupComparison(fields []string, right expressionToken, opToken string) (elastic.Query, error) {
+	symbol, _ := splitFuzziness(opToken)
+	op := comparatorSymbols[symbol]
+
+	queries := make([]elastic.Query, len(fields))
+	var matches []*matchQuery
+	for i, field := range fields {
+		c, err := it.buildComparison(expressionToken{Kind: variableToken, Value: field}, right, opToken)
+		if err != nil {
+			return nil, err
+		}
+		if match, ok := c.query.(*matchQuery); ok {
+			matches = append(matches, match)
+		}
+		queries[i], _ = it.asQuery(expressionToken{Kind: comparisonToken, Value: c})
+	}
+
+	switch op {
+	case NEQ, NIN, NREGEXP:
+		return elastic.NewBoolQuery().Must(queries...), nil
+	case EQ:
+		if len(matches) == len(fields) {
+			return multiMatchQuery(fields, matches), nil
+		}
+	}
+	return elastic.NewBoolQuery().Should(queries...), nil
+}
+
+// multiMatchQuery merges the match queries on a group of fields. Like the comparisons it replaces,
+// it also matches the documents missing any of the fields.
+func multiMatchQuery(fields []string, matches []*matchQuery) elastic.Query {
+	names := make([]string, len(matches))
+	for i, match := range matches {
+		names[i] = match.field
+	}
+	query := elastic.NewBoolQuery().Should(elastic.NewMultiMatchQuery(matches[0].value, names...))
+	for _, field := range fields {
+		query.Should(elastic.NewBoolQuery().MustNot(elastic.NewExistsQuery(field)))
+	}
+	return query
+}
@@ -0,0 +1,10 @@
+package esqb
+
+import "github.com/olivere/elastic/v7"
+
+// Field is the argument passed to a Function for a field reference, e.g. `title` in `exists(title)`.
+// All other arguments are passed as parsed: int64, uint64, float64, string, bool, time.Time, []interface{} or elastic.Query.
+type Field string
+
+// Function builds a query from the arguments of a function call such as `prefix(title, "adm")`
+type Function func(args ...interface{}) (elastic.Query, error)
@@ -0,0 +1,23 @@
+package esqb
+
+import "strings"
+
+const defaultFuzziness = "AUTO"
+
+// Fuzzy is the value handed to FUZZY generators, e.g. `title ~=(2) "loign"`.
+// Fuzziness is the edit distance following the operator, or "AUTO" if there is none
+type Fuzzy struct {
+	Value     interface{}
+	Fuzziness string
+}
+
+// splitFuzziness splits a comparator symbol such as "~=2", read from `~=(2)`, into the symbol and the edit distance
+func splitFuzziness(symbol string) (string, string) {
+	if !strings.HasPrefix(symbol, "~=") {
+		return symbol, ""
+	}
+	if symbol == "~=" {
+		return symbol, defaultFuzziness
+	}
+	return "~=", symbol[len("~="):]
+}
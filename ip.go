@@ -0,0 +1,115 @@
+package esqb
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// IPRange is the value of IP range literals such as `1.1.1.1-1.1.1.9`
+type IPRange struct {
+	From net.IP
+	To   net.IP
+}
+
+// readIP attempts to read an unquoted IP literal: an address such as `10.0.0.1` or `2001:db8::1`,
+// a CIDR such as `10.0.0.0/8`, or a range such as `1.1.1.1-1.1.1.9`.
+// Addresses are read as net.IP and CIDRs as their canonical string.
+// Leaves the stream untouched and returns false if the next characters are not an IP literal.
+func readIP(stream *lexerStream) (interface{}, tokenKind, bool) {
+
+	var start int
+	var candidate string
+	var from, to net.IP
+	var network *net.IPNet
+	var err error
+
+	start = stream.position
+	candidate, _ = readUntilFalse(stream, true, false, false, isIPCharacter)
+
+	// a bare number or an identifier is never an IP literal
+	if strings.Count(candidate, ".") != 3 && !strings.Contains(candidate, ":") {
+		stream.rewind(stream.position - start)
+		return nil, unknownToken, false
+	}
+
+	if strings.Contains(candidate, "/") {
+		_, network, err = net.ParseCIDR(candidate)
+		if err != nil {
+			stream.rewind(stream.position - start)
+			return nil, unknownToken, false
+		}
+		return network.String(), ipToken, true
+	}
+
+	from = net.ParseIP(candidate)
+	if from == nil {
+		stream.rewind(stream.position - start)
+		return nil, unknownToken, false
+	}
+
+	// range?
+	end := stream.position
+	if stream.canRead() && stream.readCharacter() == '-' {
+
+		candidate, _ = readUntilFalse(stream, true, false, false, isIPCharacter)
+		to = net.ParseIP(candidate)
+		if to != nil && (from.To4() == nil) == (to.To4() == nil) {
+			return IPRange{From: from, To: to}, ipRangeToken, true
+		}
+	}
+	stream.rewind(stream.position - end)
+	return from, ipToken, true
+}
+
+// startsIP tells if the character just read starts something shaped like an IP literal: a digit,
+// `::`, or up to 4 hex digits followed by `:` as in `fe80::1`. Words such as `face` and placeholders
+// such as `:name` are never read as IPs.
+func startsIP(stream *lexerStream, character rune) bool {
+	if isDigit(character) {
+		return true
+	}
+	source := stream.source[stream.position-1:]
+	if character == ':' {
+		return len(source) > 1 && source[1] == ':'
+	}
+	for i, c := range source {
+		if c == ':' {
+			return i > 0
+		}
+		if i == 4 || !isHexDigit(c) {
+			return false
+		}
+	}
+	return false
+}
+
+func isIPCharacter(character rune) bool {
+	return isHexDigit(character) || character == '.' || character == ':' || character == '/'
+}
+
+// buildIPRangeComparison compiles `ip == 1.1.1.1-1.1.1.9` to a range query with both bounds
+func (it *queryBuilder) buildIPRangeComparison(field string, op Operator, right expressionToken, ipRange IPRange) (*comparison, error) {
+	if op != EQ && op != NEQ {
+		return nil, fmt.Errorf("IP range can only be used with [%s] or [%s]", EQ.String(), NEQ.String())
+	}
+	query, err := it.generate(field, GTE, ipRange.From)
+	if err != nil {
+		return nil, err
+	}
+	if bounded, ok := withBound(query, LTE, ipRange.To); ok {
+		query = bounded
+	} else {
+		upper, err := it.generate(field, LTE, ipRange.To)
+		if err != nil {
+			return nil, err
+		}
+		query = elastic.NewBoolQuery().Must(query, upper)
+	}
+	if op == NEQ {
+		query = elastic.NewBoolQuery().MustNot(query)
+	}
+	return &comparison{field: field, op: op, query: query, rightOperand: right}, nil
+}
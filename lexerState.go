@@ -22,11 +22,21 @@ var validLexerStates = []lexerState{
 		validNextKinds: []tokenKind{
 			prefixToken,
 			numericToken,
+			durationToken,
+			sizeToken,
 			booleanToken,
 			variableToken,
+			fieldGroupToken,
 			stringToken,
+			nullToken,
 			timeToken,
+			dateMathToken,
+			ipToken,
+			ipRangeToken,
+			placeholderToken,
 			clauseToken,
+			functionToken,
+			nestedToken,
 		},
 	},
 	{
@@ -37,11 +47,21 @@ var validLexerStates = []lexerState{
 		validNextKinds: []tokenKind{
 			prefixToken,
 			numericToken,
+			durationToken,
+			sizeToken,
 			booleanToken,
 			variableToken,
+			fieldGroupToken,
 			stringToken,
+			nullToken,
 			timeToken,
+			dateMathToken,
+			ipToken,
+			ipRangeToken,
+			placeholderToken,
 			clauseToken,
+			functionToken,
+			nestedToken,
 			clauseCloseToken,
 		},
 	},
@@ -52,15 +72,25 @@ var validLexerStates = []lexerState{
 		isEOF:      true,
 		isNullable: true,
 		validNextKinds: []tokenKind{
+			modifierToken,
 			compareToken,
 			numericToken,
+			durationToken,
+			sizeToken,
 			booleanToken,
 			variableToken,
 			stringToken,
+			nullToken,
 			timeToken,
+			dateMathToken,
+			ipToken,
+			ipRangeToken,
+			placeholderToken,
 			clauseToken,
 			clauseCloseToken,
 			logicalToken,
+			separatorToken,
+			boostToken,
 		},
 	},
 
@@ -70,9 +100,40 @@ var validLexerStates = []lexerState{
 		isEOF:      true,
 		isNullable: false,
 		validNextKinds: []tokenKind{
+			modifierToken,
 			compareToken,
 			logicalToken,
+			separatorToken,
 			clauseCloseToken,
+			boostToken,
+		},
+	},
+	{
+
+		kind:       durationToken,
+		isEOF:      true,
+		isNullable: false,
+		validNextKinds: []tokenKind{
+			modifierToken,
+			compareToken,
+			logicalToken,
+			separatorToken,
+			clauseCloseToken,
+			boostToken,
+		},
+	},
+	{
+
+		kind:       sizeToken,
+		isEOF:      true,
+		isNullable: false,
+		validNextKinds: []tokenKind{
+			modifierToken,
+			compareToken,
+			logicalToken,
+			separatorToken,
+			clauseCloseToken,
+			boostToken,
 		},
 	},
 	{
@@ -83,7 +144,22 @@ var validLexerStates = []lexerState{
 		validNextKinds: []tokenKind{
 			compareToken,
 			logicalToken,
+			separatorToken,
 			clauseCloseToken,
+			boostToken,
+		},
+	},
+	{
+
+		kind:       nullToken,
+		isEOF:      true,
+		isNullable: true,
+		validNextKinds: []tokenKind{
+			compareToken,
+			logicalToken,
+			separatorToken,
+			clauseCloseToken,
+			boostToken,
 		},
 	},
 	{
@@ -92,9 +168,12 @@ var validLexerStates = []lexerState{
 		isEOF:      true,
 		isNullable: false,
 		validNextKinds: []tokenKind{
+			modifierToken,
 			compareToken,
 			logicalToken,
+			separatorToken,
 			clauseCloseToken,
+			boostToken,
 		},
 	},
 	{
@@ -102,10 +181,67 @@ var validLexerStates = []lexerState{
 		kind:       timeToken,
 		isEOF:      true,
 		isNullable: false,
+		validNextKinds: []tokenKind{
+			modifierToken,
+			compareToken,
+			logicalToken,
+			separatorToken,
+			clauseCloseToken,
+			boostToken,
+		},
+	},
+	{
+
+		kind:       dateMathToken,
+		isEOF:      true,
+		isNullable: false,
+		validNextKinds: []tokenKind{
+			modifierToken,
+			compareToken,
+			logicalToken,
+			separatorToken,
+			clauseCloseToken,
+			boostToken,
+		},
+	},
+	{
+
+		kind:       ipToken,
+		isEOF:      true,
+		isNullable: false,
 		validNextKinds: []tokenKind{
 			compareToken,
 			logicalToken,
+			separatorToken,
 			clauseCloseToken,
+			boostToken,
+		},
+	},
+	{
+
+		kind:       ipRangeToken,
+		isEOF:      true,
+		isNullable: false,
+		validNextKinds: []tokenKind{
+			compareToken,
+			logicalToken,
+			separatorToken,
+			clauseCloseToken,
+			boostToken,
+		},
+	},
+	{
+
+		kind:       placeholderToken,
+		isEOF:      true,
+		isNullable: false,
+		validNextKinds: []tokenKind{
+			modifierToken,
+			compareToken,
+			logicalToken,
+			separatorToken,
+			clauseCloseToken,
+			boostToken,
 		},
 	},
 	{
@@ -116,7 +252,47 @@ var validLexerStates = []lexerState{
 		validNextKinds: []tokenKind{
 			compareToken,
 			logicalToken,
+			separatorToken,
 			clauseCloseToken,
+			boostToken,
+		},
+	},
+	{
+
+		kind:       fieldGroupToken,
+		isEOF:      false,
+		isNullable: false,
+		validNextKinds: []tokenKind{
+			compareToken,
+		},
+	},
+	{
+
+		kind:       arrayToken,
+		isEOF:      true,
+		isNullable: false,
+		validNextKinds: []tokenKind{
+			compareToken,
+			logicalToken,
+			separatorToken,
+			clauseCloseToken,
+			boostToken,
+		},
+	},
+	{
+
+		kind:       modifierToken,
+		isEOF:      false,
+		isNullable: false,
+		validNextKinds: []tokenKind{
+			prefixToken,
+			numericToken,
+			durationToken,
+			sizeToken,
+			stringToken,
+			timeToken,
+			placeholderToken,
+			clauseToken,
 		},
 	},
 	{
@@ -127,11 +303,21 @@ var validLexerStates = []lexerState{
 		validNextKinds: []tokenKind{
 			prefixToken,
 			numericToken,
+			durationToken,
+			sizeToken,
 			booleanToken,
 			variableToken,
 			stringToken,
+			nullToken,
 			timeToken,
+			dateMathToken,
+			ipToken,
+			ipRangeToken,
+			placeholderToken,
+			arrayToken,
 			clauseToken,
+			functionToken,
+			nestedToken,
 			clauseCloseToken,
 		},
 	},
@@ -143,11 +329,21 @@ var validLexerStates = []lexerState{
 		validNextKinds: []tokenKind{
 			prefixToken,
 			numericToken,
+			durationToken,
+			sizeToken,
 			booleanToken,
 			variableToken,
+			fieldGroupToken,
 			stringToken,
+			nullToken,
 			timeToken,
+			dateMathToken,
+			ipToken,
+			ipRangeToken,
+			placeholderToken,
 			clauseToken,
+			functionToken,
+			nestedToken,
 			clauseCloseToken,
 		},
 	},
@@ -157,13 +353,106 @@ var validLexerStates = []lexerState{
 		isEOF:      false,
 		isNullable: false,
 		validNextKinds: []tokenKind{
+			prefixToken,
 			numericToken,
+			durationToken,
+			sizeToken,
 			booleanToken,
 			variableToken,
+			placeholderToken,
 			clauseToken,
+			functionToken,
+			nestedToken,
 			clauseCloseToken,
 		},
 	},
+	{
+
+		kind:       functionToken,
+		isEOF:      false,
+		isNullable: false,
+		validNextKinds: []tokenKind{
+			prefixToken,
+			numericToken,
+			durationToken,
+			sizeToken,
+			booleanToken,
+			variableToken,
+			stringToken,
+			nullToken,
+			timeToken,
+			dateMathToken,
+			ipToken,
+			ipRangeToken,
+			placeholderToken,
+			arrayToken,
+			clauseToken,
+			functionToken,
+			nestedToken,
+			clauseCloseToken,
+		},
+	},
+	{
+
+		kind:       nestedToken,
+		isEOF:      false,
+		isNullable: false,
+		validNextKinds: []tokenKind{
+			prefixToken,
+			numericToken,
+			durationToken,
+			sizeToken,
+			booleanToken,
+			variableToken,
+			fieldGroupToken,
+			stringToken,
+			nullToken,
+			timeToken,
+			dateMathToken,
+			ipToken,
+			ipRangeToken,
+			placeholderToken,
+			clauseToken,
+			functionToken,
+			nestedToken,
+		},
+	},
+	{
+
+		kind:       boostToken,
+		isEOF:      true,
+		isNullable: false,
+		validNextKinds: []tokenKind{
+			logicalToken,
+			separatorToken,
+			clauseCloseToken,
+		},
+	},
+	{
+
+		kind:       separatorToken,
+		isEOF:      false,
+		isNullable: false,
+		validNextKinds: []tokenKind{
+			prefixToken,
+			numericToken,
+			durationToken,
+			sizeToken,
+			booleanToken,
+			variableToken,
+			stringToken,
+			nullToken,
+			timeToken,
+			dateMathToken,
+			ipToken,
+			ipRangeToken,
+			placeholderToken,
+			arrayToken,
+			clauseToken,
+			functionToken,
+			nestedToken,
+		},
+	},
 }
 
 func (it lexerState) canTransitionTo(kind tokenKind) bool {
@@ -188,6 +477,10 @@ func checkExpressionSyntax(tokens []expressionToken) error {
 
 	for _, token := range tokens {
 
+		if token.Kind == commentToken {
+			continue
+		}
+
 		if !state.canTransitionTo(token.Kind) {
 
 			// call out a specific error for tokens looking like they want to be functions.
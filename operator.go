@@ -14,6 +14,23 @@ const (
 	LT
 	GTE
 	LTE
+	IN
+	NIN
+	REGEXP
+	NREGEXP
+	LIKE
+	CONTAINS
+	STARTSWITH
+	ENDSWITH
+	FUZZY
+	// SCRIPT isn't a comparator, its generator tells how to read the field in scripts, see ScriptAccessor
+	SCRIPT
+
+	plus
+	minus
+	multiply
+	divide
+	modulus
 
 	and
 	or
@@ -21,12 +38,16 @@ const (
 	negate
 	invert
 	bitwiseNot
+	logicalNot
 )
 
 const (
 	valuePrecedence = -iota
 	prefixPrecedence
+	multiplicativePrecedence
+	additivePrecedence
 	comparatorPrecedence
+	logicalNotPrecedence
 	logicalAndPrecedence
 	logicalOrPrecedence
 )
@@ -44,7 +65,37 @@ func (it Operator) precedence() int {
 	case LT:
 		fallthrough
 	case GTE:
+		fallthrough
+	case LTE:
+		fallthrough
+	case IN:
+		fallthrough
+	case NIN:
+		fallthrough
+	case REGEXP:
+		fallthrough
+	case NREGEXP:
+		fallthrough
+	case LIKE:
+		fallthrough
+	case CONTAINS:
+		fallthrough
+	case STARTSWITH:
+		fallthrough
+	case ENDSWITH:
+		fallthrough
+	case FUZZY:
 		return comparatorPrecedence
+	case plus:
+		fallthrough
+	case minus:
+		return additivePrecedence
+	case multiply:
+		fallthrough
+	case divide:
+		fallthrough
+	case modulus:
+		return multiplicativePrecedence
 	case and:
 		return logicalAndPrecedence
 	case or:
@@ -55,6 +106,8 @@ func (it Operator) precedence() int {
 		fallthrough
 	case invert:
 		return prefixPrecedence
+	case logicalNot:
+		return logicalNotPrecedence
 	}
 
 	return valuePrecedence
@@ -66,12 +119,30 @@ func (it Operator) precedence() int {
 	Also used during evaluation to determine exactly which comparator is being used.
 */
 var comparatorSymbols = map[string]Operator{
-	"==": EQ,
-	"!=": NEQ,
-	">":  GT,
-	">=": GTE,
-	"<":  LT,
-	"<=": LTE,
+	"==":         EQ,
+	"!=":         NEQ,
+	">":          GT,
+	">=":         GTE,
+	"<":          LT,
+	"<=":         LTE,
+	"in":         IN,
+	"not in":     NIN,
+	"=~":         REGEXP,
+	"!~":         NREGEXP,
+	"like":       LIKE,
+	"*=":         LIKE,
+	"contains":   CONTAINS,
+	"startswith": STARTSWITH,
+	"endswith":   ENDSWITH,
+	"~=":         FUZZY,
+}
+
+var modifierSymbols = map[string]Operator{
+	"+": plus,
+	"-": minus,
+	"*": multiply,
+	"/": divide,
+	"%": modulus,
 }
 
 var logicalSymbols = map[string]Operator{
@@ -80,20 +151,37 @@ var logicalSymbols = map[string]Operator{
 }
 
 var operatorSymbols = map[string]Operator{
-	"==": EQ,
-	"!=": NEQ,
-	">":  GT,
-	">=": GTE,
-	"<":  LT,
-	"<=": LTE,
-	"&&": and,
-	"||": or,
+	"==":         EQ,
+	"!=":         NEQ,
+	">":          GT,
+	">=":         GTE,
+	"<":          LT,
+	"<=":         LTE,
+	"in":         IN,
+	"not in":     NIN,
+	"=~":         REGEXP,
+	"!~":         NREGEXP,
+	"like":       LIKE,
+	"*=":         LIKE,
+	"contains":   CONTAINS,
+	"startswith": STARTSWITH,
+	"endswith":   ENDSWITH,
+	"~=":         FUZZY,
+	"+":          plus,
+	"-":          minus,
+	"*":          multiply,
+	"/":          divide,
+	"%":          modulus,
+	"&&":         and,
+	"||":         or,
 }
 
 var prefixSymbols = map[string]Operator{
 	"-": negate,
 	"!": invert,
 	"~": bitwiseNot,
+	// the word "not" negates a whole comparison like in SQL, so it binds looser than comparators
+	"not": logicalNot,
 }
 
 /*
@@ -134,6 +222,36 @@ func (it Operator) String() string {
 		return ">="
 	case LTE:
 		return "<="
+	case IN:
+		return "in"
+	case NIN:
+		return "not in"
+	case REGEXP:
+		return "=~"
+	case NREGEXP:
+		return "!~"
+	case LIKE:
+		return "like"
+	case CONTAINS:
+		return "contains"
+	case STARTSWITH:
+		return "startswith"
+	case ENDSWITH:
+		return "endswith"
+	case FUZZY:
+		return "~="
+	case SCRIPT:
+		return "script"
+	case plus:
+		return "+"
+	case minus:
+		return "-"
+	case multiply:
+		return "*"
+	case divide:
+		return "/"
+	case modulus:
+		return "%"
 	case and:
 		return "&&"
 	case or:
@@ -144,6 +262,8 @@ func (it Operator) String() string {
 		return "!"
 	case bitwiseNot:
 		return "~"
+	case logicalNot:
+		return "not"
 	}
 	return ""
 }
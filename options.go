@@ -0,0 +1,54 @@
+package esqb
+
+import "strings"
+
+// Option configures a queryBuilder when it is instanciated by NewQueryBuilder
+type Option func(it *queryBuilder)
+
+// WithFunctions registers the functions which can be called in the expression, e.g. `exists(title)`
+func WithFunctions(functions map[string]Function) Option {
+	return func(it *queryBuilder) {
+		for name, function := range functions {
+			it.functions[name] = function
+		}
+	}
+}
+
+// WithWordOperators sets the case-insensitive words which can be used instead of operator symbols,
+// e.g. {"and": "&&", "or": "||", "not": "!"} which is the default. An empty map disables word operators.
+// Word operators are only recognized where such an operator is expected, so that `or == 1` still refers to a field named `or`.
+func WithWordOperators(words map[string]string) Option {
+	return func(it *queryBuilder) {
+		it.scanOptions.wordOperators = make(map[string]string)
+		for word, symbol := range words {
+			it.scanOptions.wordOperators[strings.ToLower(word)] = symbol
+		}
+	}
+}
+
+// WithLenientMode enables the search-box mode, where adjacent operands are implicitly ANDed
+// and bare words such as `login page` are free-text terms handled by the default generator.
+func WithLenientMode() Option {
+	return func(it *queryBuilder) {
+		it.scanOptions.lenient = true
+	}
+}
+
+// WithDefaultGenerator sets the generator for free-text terms which don't belong to a field,
+// e.g. `"login page"`, typically a multi_match query over several fields.
+func WithDefaultGenerator(generator QueryGenerator) Option {
+	return func(it *queryBuilder) {
+		it.defaultGenerator = generator
+	}
+}
+
+// WithFlagFields sets the boolean fields which can be written alone, e.g. `is_honeypot && !is_cdn`
+// for `is_honeypot == true && is_cdn == false`. Their EQ generator receives the boolean.
+// In lenient mode, other bare words stay free-text terms even if they name a field.
+func WithFlagFields(fields ...string) Option {
+	return func(it *queryBuilder) {
+		for _, field := range fields {
+			it.flagFields[field] = true
+		}
+	}
+}
@@ -3,37 +3,83 @@ package esqb
 import (
   "errors"
   "fmt"
+  "math"
+  "net"
+  "reflect"
+  "time"
 
   "github.com/olivere/elastic/v7"
 )
 
 type QueryGenerator func(value interface{}) elastic.Query
 
+// comparison is the result of a comparator, kept unwrapped until it is used as a query
+// so that a chained comparator can still add its bound to it.
+type comparison struct {
+  field string
+  op    Operator
+  query elastic.Query
+  // the operand on the right side in the expression, `port` for `1024 <= port`
+  rightOperand expressionToken
+  // the query checks the existence of the field itself, so it must not be skipped for missing fields
+  checksExistence bool
+}
+
 type queryBuilder struct {
   suffixTokens []expressionToken
+  comments     []Comment
   queryFactory map[string]map[Operator]QueryGenerator
-  queried      map[string]bool
+  functions    map[string]Function
+  // fields queried and placeholder values of the build in progress
+  queried map[string]bool
+  params  Params
+
+  scanOptions scanOptions
+  // generator for free-text terms, nil if they are not allowed
+  defaultGenerator QueryGenerator
+
+  leadingWildcard     LeadingWildcard
+  reversedFieldSuffix string
+  // units sizes and durations are converted to before calling the generators of a field
+  sizeUnits     map[string]ByteSize
+  durationUnits map[string]time.Duration
+  // boolean fields which can be written alone, e.g. `is_honeypot`
+  flagFields map[string]bool
 }
 
-func NewQueryBuilder(expr string, queryFactory map[string]map[Operator]QueryGenerator) (*queryBuilder, error) {
+func NewQueryBuilder(expr string, queryFactory map[string]map[Operator]QueryGenerator, options ...Option) (*queryBuilder, error) {
   var err error
   it := &queryBuilder{
     queryFactory: queryFactory,
-    queried:      make(map[string]bool),
+    functions:    make(map[string]Function),
+
+    scanOptions: defaultScanOptions(),
+
+    reversedFieldSuffix: defaultReversedFieldSuffix,
+    sizeUnits:           make(map[string]ByteSize),
+    durationUnits:       make(map[string]time.Duration),
+    flagFields:          make(map[string]bool),
   }
-  // NEQ is the opposite of EQ
-  for _, generators := range queryFactory {
-    if _, ok := generators[EQ]; ok {
-      eqGenerator := generators[EQ]
-      generators[NEQ] = func(value interface{}) elastic.Query {
-        return elastic.NewBoolQuery().MustNot(eqGenerator(value))
-      }
-    }
+  for _, option := range options {
+    option(it)
+  }
+  for field, generators := range queryFactory {
+    deriveGenerators(field, generators)
   }
-  tokens, err := scanTokens(expr)
+  tokens, err := scanTokens(expr, it.scanOptions)
   if err != nil {
     return nil, err
   }
+  for _, token := range tokens {
+    if token.Kind == commentToken {
+      it.comments = append(it.comments, token.Value.(Comment))
+    }
+    if token.Kind == functionToken {
+      if _, ok := it.functions[token.Value.(string)]; !ok {
+        return nil, errors.New("Undefined function " + token.Value.(string))
+      }
+    }
+  }
   it.suffixTokens, err = convertToSuffix(tokens)
   if err != nil {
     return nil, err
@@ -41,67 +87,348 @@ func NewQueryBuilder(expr string, queryFactory map[string]map[Operator]QueryGene
   return it, nil
 }
 
-func (it *queryBuilder) Build() (elastic.Query, map[string]bool, error) {
+// Params binds placeholders to values, `:ip` and `$1` are bound by the keys "ip" and "1"
+type Params map[string]interface{}
+
+// Build builds the query, binding the placeholders of the expression to the given params.
+// It can be called concurrently, so that one expression can be reused for many requests.
+func (it *queryBuilder) Build(params ...Params) (elastic.Query, map[string]bool, error) {
+  builder := *it
+  builder.queried = make(map[string]bool)
+  builder.params = make(Params)
+  for _, p := range params {
+    for name, value := range p {
+      builder.params[name] = value
+    }
+  }
+  return builder.build()
+}
+
+func (it *queryBuilder) build() (elastic.Query, map[string]bool, error) {
   var stack []expressionToken
   for _, token := range it.suffixTokens {
-    if !token.isOperator() {
-      stack = append(stack, token)
-    } else {
+    switch token.Kind {
+    case placeholderToken:
+      value, ok := it.params[token.Value.(string)]
+      if !ok {
+        return nil, nil, fmt.Errorf("parameter [%s] is not bound", token.Value)
+      }
+      stack = append(stack, bindParameter(value))
+    case prefixToken:
+      if len(stack) < 1 {
+        return nil, nil, errors.New("missing operand")
+      }
+      operand := stack[len(stack)-1]
+      stack = stack[:len(stack)-1]
+      opToken := token.Value.(string)
+      if opToken == "-" && it.scanOptions.lenient && operand.Kind != numericToken && !isQuantity(operand.Kind) {
+        // in the search-box mode, `-admin` excludes a term like `!admin` does
+        opToken = "!"
+      } else if opToken == "-" {
+        // negative value, e.g. `-(3 * 2)`
+        result, err := negateOperand(operand)
+        if err != nil {
+          return nil, nil, err
+        }
+        stack = append(stack, result)
+        continue
+      }
+      query, err := it.buildPrefixQuery(operand, opToken)
+      if err != nil {
+        return nil, nil, err
+      }
+      stack = append(stack, expressionToken{Kind: esQueryToken, Value: query})
+    case modifierToken:
       if len(stack) < 2 {
         return nil, nil, errors.New("missing operands")
       }
       left, right := stack[len(stack)-2], stack[len(stack)-1]
       stack = stack[:len(stack)-2]
+      result, err := foldModifier(left, right, token.Value.(string))
+      if err != nil {
+        return nil, nil, err
+      }
+      stack = append(stack, result)
+    case compareToken, logicalToken:
+      if len(stack) < 2 {
+        return nil, nil, errors.New("missing operands")
+      }
+      left, right := stack[len(stack)-2], stack[len(stack)-1]
+      stack = stack[:len(stack)-2]
+      if token.Kind == compareToken && left.Kind == fieldGroupToken {
+        query, err := it.buildFieldGroupComparison(left.Value.([]string), right, token.Value.(string))
+        if err != nil {
+          return nil, nil, err
+        }
+        stack = append(stack, expressionToken{Kind: esQueryToken, Value: query})
+        continue
+      }
+      if token.Kind == compareToken {
+        c, err := it.buildComparison(left, right, token.Value.(string))
+        if err != nil {
+          return nil, nil, err
+        }
+        stack = append(stack, expressionToken{Kind: comparisonToken, Value: c})
+        continue
+      }
       query, err := it.buildSubQuery(left, right, token.Value.(string))
       if err != nil {
         return nil, nil, err
       }
       stack = append(stack, expressionToken{Kind: esQueryToken, Value: query})
+    case nestedToken:
+      if len(stack) < 1 {
+        return nil, nil, errors.New("missing operand")
+      }
+      query, ok := it.asQuery(stack[len(stack)-1])
+      if !ok {
+        return nil, nil, fmt.Errorf("nested [%s] should contain a booleanToken expression", token.Value)
+      }
+      stack[len(stack)-1] = expressionToken{Kind: esQueryToken, Value: elastic.NewNestedQuery(token.Value.(string), query)}
+    case boostToken:
+      if len(stack) < 1 {
+        return nil, nil, errors.New("missing operand")
+      }
+      operand := stack[len(stack)-1]
+      if operand.Kind == comparisonToken {
+        // boost the generated query, the existence check stays unboosted
+        c := operand.Value.(*comparison)
+        c.query = boostQuery(c.query, token.Value.(float64))
+        continue
+      }
+      query, ok := it.asQuery(operand)
+      if !ok {
+        return nil, nil, errors.New("boost should follow a comparison or a group")
+      }
+      stack[len(stack)-1] = expressionToken{Kind: esQueryToken, Value: boostQuery(query, token.Value.(float64))}
+    case functionToken:
+      call := token.Value.(functionCall)
+      if len(stack) < call.arity {
+        return nil, nil, errors.New("missing arguments")
+      }
+      args := stack[len(stack)-call.arity:]
+      stack = stack[:len(stack)-call.arity]
+      query, err := it.buildFunctionQuery(call.name, args)
+      if err != nil {
+        return nil, nil, err
+      }
+      stack = append(stack, expressionToken{Kind: esQueryToken, Value: query})
+    default:
+      stack = append(stack, token)
     }
   }
   if len(stack) != 1 {
     return nil, nil, errors.New("query build failed")
   } else {
-    return stack[len(stack)-1].Value.(elastic.Query), it.queried, nil
+    query, ok := it.asQuery(stack[len(stack)-1])
+    if !ok {
+      return nil, nil, errors.New("expression is not a booleanToken expression")
+    }
+    return query, it.queried, nil
   }
 }
 
-func (it *queryBuilder) buildSubQuery(left, right expressionToken, opToken string) (elastic.Query, error) {
-  if op, ok := comparatorSymbols[opToken]; ok {
-    // if comparator, then left should be field tag
-    var field string
-    var v interface{}
-    if left.Kind == variableToken {
-      field = left.Value.(string)
-      v = right.Value
-    } else if right.Kind == variableToken {
-      switch op {
-      case LTE:
-        op = GTE
-      case LT:
-        op = GT
-      case GTE:
-        op = LTE
-      case GT:
-        op = LT
-      }
-      field = right.Value.(string)
-      v = left.Value
+func (it *queryBuilder) buildPrefixQuery(operand expressionToken, opToken string) (elastic.Query, error) {
+  op, ok := prefixSymbols[opToken]
+  if !ok || op != invert && op != logicalNot {
+    return nil, fmt.Errorf("op [%v] not supportted by query builder", opToken)
+  }
+  if operand.Kind == variableToken {
+    // `!is_cdn` is `is_cdn == false`, rather than the negation of `is_cdn == true`
+    if query, ok := it.flagQuery(operand.Value.(string), false); ok {
+      return query, nil
+    }
+  }
+  query, ok := it.asQuery(operand)
+  if !ok {
+    return nil, fmt.Errorf("operand beside [%s] should be booleanToken expression", op.String())
+  }
+  return elastic.NewBoolQuery().MustNot(query), nil
+}
+
+// flagQuery compiles a bare flag field to a comparison with a boolean, false if the field isn't a flag, see WithFlagFields
+func (it *queryBuilder) flagQuery(field string, value bool) (elastic.Query, bool) {
+  if !it.flagFields[field] {
+    return nil, false
+  }
+  query, err := it.generate(field, EQ, value)
+  if err != nil {
+    return nil, false
+  }
+  return skipIfFieldNotExist(field, query), true
+}
+
+func (it *queryBuilder) buildFunctionQuery(name string, args []expressionToken) (elastic.Query, error) {
+  values := make([]interface{}, len(args))
+  for i, arg := range args {
+    if arg.Kind == variableToken {
+      // fields are typed, so that functions can tell them from string literals
+      it.queried[arg.Value.(string)] = true
+      values[i] = Field(arg.Value.(string))
+    } else if query, ok := it.asQuery(arg); ok {
+      values[i] = query
     } else {
-      return nil, errors.New("field or value invalid")
+      values[i] = arg.Value
     }
-    it.queried[field] = true
-    return skipIfFieldNotExist(field, it.queryFactory[field][op](v)), nil
-  } else if op, ok := logicalSymbols[opToken]; ok {
+  }
+  query, err := it.functions[name](values...)
+  if err != nil {
+    return nil, fmt.Errorf("function [%s] failed: %v", name, err)
+  }
+  return query, nil
+}
+
+func (it *queryBuilder) buildComparison(left, right expressionToken, opToken string) (*comparison, error) {
+  opToken, fuzziness := splitFuzziness(opToken)
+  op := comparatorSymbols[opToken]
+  if left.Kind == comparisonToken {
+    return it.chainComparison(left.Value.(*comparison), op, right)
+  }
+  // if comparator, then one of the operands should be field tag
+  var field string
+  var operand expressionToken
+  if op == IN || op == NIN {
+    // the list is always on the right side, e.g. `ip in ["1.1.1.1", "2.2.2.2"]`
+    if left.Kind != variableToken || right.Kind != arrayToken {
+      return nil, fmt.Errorf("operand beside [%s] should be a field and a list", op.String())
+    }
+    field = left.Value.(string)
+    operand = right
+  } else if left.Kind == arrayToken || right.Kind == arrayToken {
+    return nil, fmt.Errorf("list can only be used with [%s] or [%s]", IN.String(), NIN.String())
+  } else if left.Kind == variableToken && right.Kind == variableToken {
+    return it.buildFieldComparison(left.Value.(string), op, right)
+  } else if left.Kind == variableToken {
+    field = left.Value.(string)
+    operand = right
+  } else if right.Kind == variableToken {
+    op = flipComparator(op)
+    field = right.Value.(string)
+    operand = left
+  } else {
+    return nil, errors.New("field or value invalid")
+  }
+  if operand.Kind == nullToken {
+    return it.buildNullComparison(field, op, right)
+  }
+  if operand.Kind == ipRangeToken {
+    return it.buildIPRangeComparison(field, op, right, operand.Value.(IPRange))
+  }
+  v := it.normalizeUnit(field, operand.Value)
+  if op == FUZZY {
+    v = Fuzzy{Value: v, Fuzziness: fuzziness}
+  }
+  if op == LIKE {
+    query, err := it.rewriteLeadingWildcard(field, v)
+    if err != nil {
+      return nil, err
+    }
+    if query != nil {
+      it.queried[field] = true
+      return &comparison{field: field, op: op, query: query, rightOperand: right}, nil
+    }
+  }
+  if op == ENDSWITH {
+    query, err := it.suffixQuery(field, v)
+    if err != nil {
+      return nil, err
+    }
+    if query != nil {
+      it.queried[field] = true
+      return &comparison{field: field, op: op, query: query, rightOperand: right}, nil
+    }
+  }
+  query, err := it.generate(field, op, v)
+  if err != nil {
+    return nil, err
+  }
+  return &comparison{field: field, op: op, query: query, rightOperand: right}, nil
+}
+
+// buildNullComparison compiles `field == null` and `field != null` to existence checks
+func (it *queryBuilder) buildNullComparison(field string, op Operator, right expressionToken) (*comparison, error) {
+  var query elastic.Query
+  switch op {
+  case EQ:
+    query = elastic.NewBoolQuery().MustNot(elastic.NewExistsQuery(field))
+  case NEQ:
+    query = elastic.NewExistsQuery(field)
+  default:
+    return nil, fmt.Errorf("null can only be used with [%s] or [%s]", EQ.String(), NEQ.String())
+  }
+  it.queried[field] = true
+  return &comparison{field: field, op: op, query: query, rightOperand: right, checksExistence: true}, nil
+}
+
+// chainComparison extends `1024 <= port` with `< 65535`, so that both bounds end up in one range query
+func (it *queryBuilder) chainComparison(previous *comparison, op Operator, right expressionToken) (*comparison, error) {
+  if previous.rightOperand.Kind != variableToken || previous.rightOperand.Value != previous.field || !isLiteral(right.Kind) {
+    return nil, errors.New("chained comparison should have the field in the middle, e.g. `1024 <= port < 65535`")
+  }
+  if !isRangeComparator(previous.op) || !isRangeComparator(op) {
+    return nil, fmt.Errorf("can't chain [%s] with [%s]", previous.op.String(), op.String())
+  }
+  v := it.normalizeUnit(previous.field, right.Value)
+  if query, ok := withBound(previous.query, op, v); ok {
+    return &comparison{field: previous.field, op: op, query: query, rightOperand: right}, nil
+  }
+  query, err := it.generate(previous.field, op, v)
+  if err != nil {
+    return nil, err
+  }
+  return &comparison{
+    field:        previous.field,
+    op:           op,
+    query:        elastic.NewBoolQuery().Must(previous.query, query),
+    rightOperand: right,
+  }, nil
+}
+
+// withBound returns a copy of a range query with another bound, false if the query is not a range query.
+// The query returned by the generator is left untouched, as the generator may reuse it.
+func withBound(query elastic.Query, op Operator, value interface{}) (elastic.Query, bool) {
+  rangeQuery, ok := query.(*elastic.RangeQuery)
+  if !ok {
+    return nil, false
+  }
+  bounded := *rangeQuery
+  switch op {
+  case LT:
+    bounded.Lt(value)
+  case LTE:
+    bounded.Lte(value)
+  case GT:
+    bounded.Gt(value)
+  case GTE:
+    bounded.Gte(value)
+  default:
+    return nil, false
+  }
+  return &bounded, true
+}
+
+// generate calls the generator registered for the field and operator
+func (it *queryBuilder) generate(field string, op Operator, value interface{}) (elastic.Query, error) {
+  generator, ok := it.queryFactory[field][op]
+  if !ok {
+    return nil, fmt.Errorf("op [%s] not supported by field [%s]", op.String(), field)
+  }
+  it.queried[field] = true
+  return generator(value), nil
+}
+
+func (it *queryBuilder) buildSubQuery(left, right expressionToken, opToken string) (elastic.Query, error) {
+  if op, ok := logicalSymbols[opToken]; ok {
     // if logical, left & right should all be elastic.Query
     err := fmt.Errorf("operand beside [%s] should be booleanToken expression", op.String())
-    if _, ok = left.Value.(elastic.Query); !ok {
+    q1, ok := it.asQuery(left)
+    if !ok {
       return nil, err
     }
-    if _, ok = right.Value.(elastic.Query); !ok {
+    q2, ok := it.asQuery(right)
+    if !ok {
       return nil, err
     }
-    q1, q2 := left.Value.(elastic.Query), right.Value.(elastic.Query)
     if op == and {
       return elastic.NewBoolQuery().Must(q1, q2), nil
     } else if op == or {
@@ -114,6 +441,36 @@ func (it *queryBuilder) buildSubQuery(left, right expressionToken, opToken strin
   }
 }
 
+// asQuery returns the query represented by an operand, false if the operand is not a boolean expression
+func (it *queryBuilder) asQuery(token expressionToken) (elastic.Query, bool) {
+  switch token.Kind {
+  case comparisonToken:
+    c := token.Value.(*comparison)
+    if c.checksExistence {
+      return c.query, true
+    }
+    return skipIfFieldNotExist(c.field, c.query), true
+  case esQueryToken:
+    query, ok := token.Value.(elastic.Query)
+    return query, ok
+  case stringToken, numericToken:
+    // free-text term, e.g. `"login page"`
+    if it.defaultGenerator != nil {
+      return it.defaultGenerator(token.Value), true
+    }
+  case variableToken:
+    // flag field, e.g. `is_honeypot` for `is_honeypot == true`
+    if query, ok := it.flagQuery(token.Value.(string), true); ok {
+      return query, true
+    }
+    // bare word in the search-box mode, e.g. `login page`
+    if it.defaultGenerator != nil && it.scanOptions.lenient {
+      return it.defaultGenerator(token.Value), true
+    }
+  }
+  return nil, false
+}
+
 func RangeQueryGenerators(getBaseQuery func() *elastic.RangeQuery) map[Operator]QueryGenerator {
   return map[Operator]QueryGenerator{
     LT: func(value interface{}) elastic.Query {
@@ -134,6 +491,188 @@ func RangeQueryGenerators(getBaseQuery func() *elastic.RangeQuery) map[Operator]
   }
 }
 
+// TermQueryGenerators generates EQ with a term query and IN with a single terms query,
+// and reads the field in field-to-field comparisons
+func TermQueryGenerators(field string) map[Operator]QueryGenerator {
+  return map[Operator]QueryGenerator{
+    EQ: func(value interface{}) elastic.Query {
+      return elastic.NewTermQuery(field, value)
+    },
+    IN: func(value interface{}) elastic.Query {
+      return elastic.NewTermsQuery(field, value.([]interface{})...)
+    },
+    SCRIPT: ScriptAccessor(field, ""),
+  }
+}
+
+// MatchQueryGenerators generates EQ with a match query. Field groups of such fields, e.g. `(title|body) == "login"`,
+// are compiled to a single multi_match query
+func MatchQueryGenerators(field string) map[Operator]QueryGenerator {
+  return map[Operator]QueryGenerator{
+    EQ: func(value interface{}) elastic.Query {
+      return &matchQuery{field: field, value: value}
+    },
+  }
+}
+
+// matchQuery is a plain match query which keeps its field and value, so that it can be merged into a multi_match query
+type matchQuery struct {
+  field string
+  value interface{}
+  boost *float64
+}
+
+func (it *matchQuery) Boost(boost float64) *matchQuery {
+  it.boost = &boost
+  return it
+}
+
+func (it *matchQuery) Source() (interface{}, error) {
+  query := elastic.NewMatchQuery(it.field, it.value)
+  if it.boost != nil {
+    query.Boost(*it.boost)
+  }
+  return query.Source()
+}
+
+// deriveGenerators fills in the operators which can be expressed with the registered ones
+func deriveGenerators(field string, generators map[Operator]QueryGenerator) {
+  if eqGenerator, ok := generators[EQ]; ok {
+    // NEQ is the opposite of EQ
+    generators[NEQ] = func(value interface{}) elastic.Query {
+      return elastic.NewBoolQuery().MustNot(eqGenerator(value))
+    }
+    // IN defaults to ORing EQ over every value of the list
+    if _, ok = generators[IN]; !ok {
+      generators[IN] = func(value interface{}) elastic.Query {
+        values := value.([]interface{})
+        if len(values) == 0 {
+          return elastic.NewBoolQuery().MustNot(elastic.NewMatchAllQuery())
+        }
+        query := elastic.NewBoolQuery()
+        for _, v := range values {
+          query.Should(eqGenerator(v))
+        }
+        return query
+      }
+    }
+  }
+  // NIN defaults to the opposite of IN
+  if inGenerator, ok := generators[IN]; ok {
+    if _, ok = generators[NIN]; !ok {
+      generators[NIN] = func(value interface{}) elastic.Query {
+        return elastic.NewBoolQuery().MustNot(inGenerator(value))
+      }
+    }
+  }
+  // REGEXP defaults to a regexp query on the field itself
+  if _, ok := generators[REGEXP]; !ok {
+    generators[REGEXP] = func(value interface{}) elastic.Query {
+      return elastic.NewRegexpQuery(field, fmt.Sprint(value))
+    }
+  }
+  // NREGEXP defaults to the opposite of REGEXP
+  if _, ok := generators[NREGEXP]; !ok {
+    regexpGenerator := generators[REGEXP]
+    generators[NREGEXP] = func(value interface{}) elastic.Query {
+      return elastic.NewBoolQuery().MustNot(regexpGenerator(value))
+    }
+  }
+  // LIKE defaults to a prefix or wildcard query on the field itself
+  if _, ok := generators[LIKE]; !ok {
+    generators[LIKE] = func(value interface{}) elastic.Query {
+      return patternQuery(field, fmt.Sprint(value))
+    }
+  }
+  // FUZZY defaults to a fuzzy query on the field itself
+  if _, ok := generators[FUZZY]; !ok {
+    generators[FUZZY] = func(value interface{}) elastic.Query {
+      fuzzy := value.(Fuzzy)
+      return elastic.NewFuzzyQuery(field, fuzzy.Value).Fuzziness(fuzzy.Fuzziness)
+    }
+  }
+  // CONTAINS defaults to a phrase query, STARTSWITH to a prefix query.
+  // ENDSWITH has no default generator, it follows the leading wildcard policy instead
+  if _, ok := generators[CONTAINS]; !ok {
+    generators[CONTAINS] = func(value interface{}) elastic.Query {
+      return elastic.NewMatchPhraseQuery(field, value)
+    }
+  }
+  if _, ok := generators[STARTSWITH]; !ok {
+    generators[STARTSWITH] = func(value interface{}) elastic.Query {
+      return elastic.NewPrefixQuery(field, fmt.Sprint(value))
+    }
+  }
+}
+
+// bindParameter converts a bound value to the token a literal of the same type would have been scanned to.
+// Strings are never parsed, so that user input can't change the structure of the expression.
+func bindParameter(value interface{}) expressionToken {
+  switch v := value.(type) {
+  case nil:
+    return expressionToken{Kind: nullToken}
+  case bool:
+    return expressionToken{Kind: booleanToken, Value: v}
+  case string:
+    return expressionToken{Kind: stringToken, Value: v}
+  case time.Time:
+    return expressionToken{Kind: timeToken, Value: v}
+  case time.Duration:
+    return expressionToken{Kind: durationToken, Value: v}
+  case ByteSize:
+    return expressionToken{Kind: sizeToken, Value: v}
+  case net.IP:
+    return expressionToken{Kind: ipToken, Value: v}
+  case *net.IPNet:
+    return expressionToken{Kind: ipToken, Value: v.String()}
+  case IPRange:
+    return expressionToken{Kind: ipRangeToken, Value: v}
+  case []interface{}:
+    return expressionToken{Kind: arrayToken, Value: v}
+  }
+  reflected := reflect.ValueOf(value)
+  switch reflected.Kind() {
+  case reflect.Slice, reflect.Array:
+    // byte slices such as net.IP are single values
+    if reflected.Type().Elem().Kind() != reflect.Uint8 {
+      values := make([]interface{}, reflected.Len())
+      for i := range values {
+        values[i] = reflected.Index(i).Interface()
+      }
+      return expressionToken{Kind: arrayToken, Value: values}
+    }
+  // numbers are widened like literals, so that arithmetic works on them
+  case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+    return expressionToken{Kind: numericToken, Value: reflected.Int()}
+  case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+    if reflected.Uint() > math.MaxInt64 {
+      return expressionToken{Kind: numericToken, Value: reflected.Uint()}
+    }
+    return expressionToken{Kind: numericToken, Value: int64(reflected.Uint())}
+  case reflect.Float32, reflect.Float64:
+    return expressionToken{Kind: numericToken, Value: reflected.Float()}
+  }
+  return expressionToken{Kind: stringToken, Value: value}
+}
+
+func flipComparator(op Operator) Operator {
+  switch op {
+  case LTE:
+    return GTE
+  case LT:
+    return GT
+  case GTE:
+    return LTE
+  case GT:
+    return LT
+  }
+  return op
+}
+
+func isRangeComparator(op Operator) bool {
+  return op == LT || op == LTE || op == GT || op == GTE
+}
+
 func skipIfFieldNotExist(field string, rawQuery elastic.Query) elastic.Query {
   return elastic.NewBoolQuery().Should(rawQuery, elastic.NewBoolQuery().MustNot(elastic.NewExistsQuery(field)))
 }
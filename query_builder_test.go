@@ -1,9 +1,13 @@
 package esqb
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/olivere/elastic/v7"
 )
@@ -29,10 +33,745 @@ func TestQueryBuilder_Build(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	query, err := qb.Build()
+	query, _, err := qb.Build()
 	if err != nil {
 		t.Fatal(err)
 	}
 	data, _ := json.MarshalIndent(elastic.NewSearchSource().Query(query), "", " ")
 	fmt.Println(string(data))
 }
+
+// testFactory returns a fresh query factory shared by the test cases, as the builder derives generators into it
+func testFactory() map[string]map[Operator]QueryGenerator {
+	ranges := func(field string) map[Operator]QueryGenerator {
+		return RangeQueryGenerators(func() *elastic.RangeQuery {
+			return elastic.NewRangeQuery(field)
+		})
+	}
+	factory := map[string]map[Operator]QueryGenerator{
+		"title":        MatchQueryGenerators("title"),
+		"body":         MatchQueryGenerators("body"),
+		"header":       MatchQueryGenerators("header"),
+		"organization": MatchQueryGenerators("org"),
+		"org": {
+			FUZZY: func(value interface{}) elastic.Query {
+				fuzzy := value.(Fuzzy)
+				return elastic.NewMatchQuery("org", fuzzy.Value).Fuzziness(fuzzy.Fuzziness)
+			},
+		},
+		"host": {
+			REGEXP: func(value interface{}) elastic.Query {
+				return elastic.NewRegexpQuery("host.keyword", value.(string)).Flags("ALL")
+			},
+		},
+		"tag": {
+			IN: func(value interface{}) elastic.Query {
+				return elastic.NewTermsQuery("tag", value.([]interface{})...)
+			},
+			// only documents which are tagged at all
+			NIN: func(value interface{}) elastic.Query {
+				return elastic.NewBoolQuery().Filter(elastic.NewExistsQuery("tag")).
+					MustNot(elastic.NewTermsQuery("tag", value.([]interface{})...))
+			},
+			NREGEXP: func(value interface{}) elastic.Query {
+				return elastic.NewBoolQuery().Filter(elastic.NewExistsQuery("tag")).
+					MustNot(elastic.NewRegexpQuery("tag", value.(string)))
+			},
+		},
+		"ip":  ranges("ip"),
+		"src": TermQueryGenerators("src"),
+		"ts": RangeQueryGenerators(func() *elastic.RangeQuery {
+			return elastic.NewRangeQuery("ts").Format("yyyy-MM-dd")
+		}),
+		"port":           ranges("port"),
+		"size":           ranges("size"),
+		"latency":        ranges("latency"),
+		"uptime":         ranges("uptime"),
+		"memory":         TermQueryGenerators("memory"),
+		"id":             TermQueryGenerators("id"),
+		"delta":          TermQueryGenerators("delta"),
+		"is_honeypot":    TermQueryGenerators("is_honeypot"),
+		"is_cdn":         TermQueryGenerators("is_cdn"),
+		"or":             TermQueryGenerators("or"),
+		"null":           TermQueryGenerators("null"),
+		"bytes_out":      TermQueryGenerators("bytes_out"),
+		"bytes_in":       TermQueryGenerators("bytes_in"),
+		"updated_at":     {SCRIPT: ScriptAccessor("updated", "")},
+		"created_at":     {SCRIPT: ScriptAccessor("created", "doc['created'].value.toInstant().toEpochMilli()")},
+		"vulns.severity": ranges("vulns.severity"),
+		"vulns.cve":      TermQueryGenerators("vulns.cve"),
+	}
+	factory["ip"][IN] = TermQueryGenerators("ip")[IN]
+	return factory
+}
+
+var testFunctions = map[string]Function{
+	"exists": func(args ...interface{}) (elastic.Query, error) {
+		return elastic.NewExistsQuery(string(args[0].(Field))), nil
+	},
+	"geo_distance": func(args ...interface{}) (elastic.Query, error) {
+		if len(args) != 4 {
+			return nil, fmt.Errorf("expected 4 arguments, got %d", len(args))
+		}
+		return elastic.NewGeoDistanceQuery(string(args[0].(Field))).
+			Lat(args[1].(float64)).Lon(args[2].(float64)).Distance(args[3].(string)), nil
+	},
+}
+
+func freeText(value interface{}) elastic.Query {
+	return elastic.NewMultiMatchQuery(value, "title", "body")
+}
+
+var flagFields = WithFlagFields("is_honeypot", "is_cdn")
+
+var searchBox = []Option{WithLenientMode(), WithDefaultGenerator(freeText), flagFields}
+
+var buildTests = []struct {
+	name     string
+	expr     string
+	options  []Option
+	params   Params
+	expected string // the query as JSON, empty if the expression must be rejected
+	queried  []string
+}{
+	{
+		name: "negation",
+		expr: `!(organization=="baidu" || title=="x")&&!(title=="y")`,
+		expected: must(
+			mustNot(should(
+				orMissing("organization", `{"match":{"org":{"query":"baidu"}}}`),
+				orMissing("title", `{"match":{"title":{"query":"x"}}}`),
+			)),
+			mustNot(orMissing("title", `{"match":{"title":{"query":"y"}}}`)),
+		),
+	},
+	{
+		name: "in",
+		expr: `ip in ["1.1.1.1", "2.2.2.2"] && title not in ["x", 'y']`,
+		expected: must(
+			orMissing("ip", `{"terms":{"ip":["1.1.1.1","2.2.2.2"]}}`),
+			orMissing("title", mustNot(should(`{"match":{"title":{"query":"x"}}}`, `{"match":{"title":{"query":"y"}}}`))),
+		),
+	},
+	{
+		name: "registered not in",
+		expr: `tag not in ["spam"]`,
+		expected: orMissing("tag",
+			`{"bool":{"filter":{"exists":{"field":"tag"}},"must_not":{"terms":{"tag":["spam"]}}}}`),
+	},
+	{
+		name: "registered not regexp",
+		expr: `tag !~ "sp.m"`,
+		expected: orMissing("tag",
+			`{"bool":{"filter":{"exists":{"field":"tag"}},"must_not":{"regexp":{"tag":{"value":"sp.m"}}}}}`),
+	},
+	{
+		name:    "function",
+		expr:    `exists(title) && !geo_distance(location, 39.9, 116.4, "10km")`,
+		options: []Option{WithFunctions(testFunctions)},
+		expected: must(
+			`{"exists":{"field":"title"}}`,
+			mustNot(`{"geo_distance":{"distance":"10km","location":{"lat":39.9,"lon":116.4}}}`),
+		),
+		queried: []string{"title", "location"},
+	},
+	{name: "undefined function", expr: `prefix(title, "adm")`, options: []Option{WithFunctions(testFunctions)}},
+	{
+		name: "regexp",
+		expr: `title=~"adm.*" && host!~".*\\.cn"`,
+		expected: must(
+			orMissing("title", `{"regexp":{"title":{"value":"adm.*"}}}`),
+			orMissing("host", mustNot(`{"regexp":{"host.keyword":{"flags":"ALL","value":".*\\.cn"}}}`)),
+		),
+	},
+	{
+		name: "like",
+		expr: `title like "admin*" && host *= "*.baidu.com"`,
+		expected: must(
+			orMissing("title", `{"prefix":{"title":"admin"}}`),
+			orMissing("host", `{"wildcard":{"host":{"value":"*.baidu.com"}}}`),
+		),
+	},
+	{
+		name:    "like reversed",
+		expr:    `title like "admin*" && host *= "*.baidu.com"`,
+		options: []Option{WithLeadingWildcard(ReverseLeadingWildcard)},
+		expected: must(
+			orMissing("title", `{"prefix":{"title":"admin"}}`),
+			orMissing("host", `{"prefix":{"host.reversed":"moc.udiab."}}`),
+		),
+	},
+	{name: "like rejected", expr: `host *= "*.baidu.com"`, options: []Option{WithLeadingWildcard(RejectLeadingWildcard)}},
+	// endswith matches its value literally, so the `*` typed by the user is escaped: `*\*.gov.cn`
+	// only matches hosts ending with "*.gov.cn", use `like "*.gov.cn"` for a wildcard
+	{
+		name: "string operators",
+		expr: `title contains "admin login" && title startswith "adm" && host endswith "*.gov.cn"`,
+		expected: must(
+			must(
+				orMissing("title", `{"match_phrase":{"title":{"query":"admin login"}}}`),
+				orMissing("title", `{"prefix":{"title":"adm"}}`),
+			),
+			orMissing("host", `{"wildcard":{"host":{"value":"*\\*.gov.cn"}}}`),
+		),
+	},
+	{
+		name:     "endswith reversed",
+		expr:     `host endswith ".gov.cn"`,
+		options:  []Option{WithLeadingWildcard(ReverseLeadingWildcard)},
+		expected: orMissing("host", `{"prefix":{"host.reversed":"nc.vog."}}`),
+	},
+	{
+		name: "boost",
+		expr: `title == "login"^3 || (body == "login" || body == null)^0.5`,
+		expected: should(
+			orMissing("title", `{"match":{"title":{"boost":3,"query":"login"}}}`),
+			`{"bool":{"boost":0.5,"should":[`+orMissing("body", `{"match":{"body":{"query":"login"}}}`)+`,`+missing("body")+`]}}`,
+		),
+	},
+	{name: "boost without value", expr: `title == "login"^`},
+	{name: "boost on field", expr: `title ^2 == "login"`},
+	{name: "boost twice", expr: `title == "login"^2^3`},
+	{
+		name: "fuzzy",
+		expr: `title ~= "loign" && org ~=( 2 ) "anthorpic" && org ~=1 "anthorpic"`,
+		expected: must(
+			must(
+				orMissing("title", `{"fuzzy":{"title":{"fuzziness":"AUTO","value":"loign"}}}`),
+				orMissing("org", `{"match":{"org":{"fuzziness":"2","query":"anthorpic"}}}`),
+			),
+			orMissing("org", `{"match":{"org":{"fuzziness":"1","query":"anthorpic"}}}`),
+		),
+	},
+	// the distance directly follows the operator, a spaced number or parenthesized value is the value
+	{
+		name: "fuzzy value in parentheses",
+		expr: `title ~= ("loign") && title ~=("loign")`,
+		expected: must(
+			orMissing("title", `{"fuzzy":{"title":{"fuzziness":"AUTO","value":"loign"}}}`),
+			orMissing("title", `{"fuzzy":{"title":{"fuzziness":"AUTO","value":"loign"}}}`),
+		),
+	},
+	{
+		name:     "fuzzy number",
+		expr:     `title ~= 2`,
+		expected: orMissing("title", `{"fuzzy":{"title":{"fuzziness":"AUTO","value":2}}}`),
+	},
+	{name: "fuzziness out of range", expr: `title ~=(3) "loign"`},
+	{name: "glued fuzziness out of range", expr: `title ~=12 "loign"`},
+	{
+		name:     "glued fuzziness in lenient mode",
+		expr:     `title ~=2 "loign"`,
+		options:  searchBox,
+		expected: orMissing("title", `{"fuzzy":{"title":{"fuzziness":"2","value":"loign"}}}`),
+	},
+	{
+		name:     "chained comparison",
+		expr:     `1024 <= port < 65535`,
+		expected: orMissing("port", `{"range":{"port":{"from":1024,"include_lower":true,"include_upper":false,"to":65535}}}`),
+	},
+	{name: "chained comparison without field", expr: `port > 1024 < 65535`},
+	{
+		name: "word operators",
+		expr: `title == "x" AND NOT (title == "y" Or or == 1)`,
+		expected: must(
+			orMissing("title", `{"match":{"title":{"query":"x"}}}`),
+			mustNot(should(
+				orMissing("title", `{"match":{"title":{"query":"y"}}}`),
+				orMissing("or", `{"term":{"or":1}}`),
+			)),
+		),
+		queried: []string{"or"},
+	},
+	{
+		name: "word not before comparison",
+		expr: `title == "x" AND NOT organization == "y" OR not title == "z"`,
+		expected: should(
+			must(
+				orMissing("title", `{"match":{"title":{"query":"x"}}}`),
+				mustNot(orMissing("organization", `{"match":{"org":{"query":"y"}}}`)),
+			),
+			mustNot(orMissing("title", `{"match":{"title":{"query":"z"}}}`)),
+		),
+	},
+	{
+		name:    "lenient word not",
+		expr:    `login not title == "x"`,
+		options: searchBox,
+		expected: must(
+			`{"multi_match":{"fields":["title","body"],"query":"login"}}`,
+			mustNot(orMissing("title", `{"match":{"title":{"query":"x"}}}`)),
+		),
+	},
+	{
+		name: "word comparators",
+		expr: `title NOT IN ["a"] && host LIKE "adm*" && ip In ["1.1.1.1"]`,
+		expected: must(
+			must(
+				orMissing("title", mustNot(`{"bool":{"should":{"match":{"title":{"query":"a"}}}}}`)),
+				orMissing("host", `{"prefix":{"host":"adm"}}`),
+			),
+			orMissing("ip", `{"terms":{"ip":["1.1.1.1"]}}`),
+		),
+	},
+	{name: "word operators disabled", expr: `title == "x" and title == "y"`, options: []Option{WithWordOperators(nil)}},
+	{
+		name:    "lenient",
+		expr:    `"login page" admin title=="x"^2 !(title=="y")`,
+		options: searchBox,
+		expected: must(
+			must(
+				must(
+					`{"multi_match":{"fields":["title","body"],"query":"login page"}}`,
+					`{"multi_match":{"fields":["title","body"],"query":"admin"}}`,
+				),
+				orMissing("title", `{"match":{"title":{"boost":2,"query":"x"}}}`),
+			),
+			mustNot(orMissing("title", `{"match":{"title":{"query":"y"}}}`)),
+		),
+	},
+	{
+		name:    "lenient not in",
+		expr:    `login title not in ["a","b"] title NOT IN ["a"]`,
+		options: searchBox,
+		expected: must(
+			must(
+				`{"multi_match":{"fields":["title","body"],"query":"login"}}`,
+				orMissing("title", mustNot(should(`{"match":{"title":{"query":"a"}}}`, `{"match":{"title":{"query":"b"}}}`))),
+			),
+			orMissing("title", mustNot(`{"bool":{"should":{"match":{"title":{"query":"a"}}}}}`)),
+		),
+	},
+	// `-admin` excludes free text like `!admin`, while `-1` stays a negative number
+	{
+		name:    "lenient minus",
+		expr:    `login -admin -is_cdn delta == -1`,
+		options: searchBox,
+		expected: must(
+			must(
+				must(
+					`{"multi_match":{"fields":["title","body"],"query":"login"}}`,
+					mustNot(`{"multi_match":{"fields":["title","body"],"query":"admin"}}`),
+				),
+				orMissing("is_cdn", `{"term":{"is_cdn":false}}`),
+			),
+			orMissing("delta", `{"term":{"delta":-1}}`),
+		),
+	},
+	{
+		name:    "lenient hyphenated word",
+		expr:    `e-mail -spam`,
+		options: searchBox,
+		expected: must(
+			`{"multi_match":{"fields":["title","body"],"query":"e-mail"}}`,
+			mustNot(`{"multi_match":{"fields":["title","body"],"query":"spam"}}`),
+		),
+	},
+	// `#` doesn't start a comment in lenient mode, as it appears in search terms
+	{
+		name:    "lenient hash",
+		expr:    `C# developer #hashtag // not a term`,
+		options: searchBox,
+		expected: must(
+			must(
+				`{"multi_match":{"fields":["title","body"],"query":"C#"}}`,
+				`{"multi_match":{"fields":["title","body"],"query":"developer"}}`,
+			),
+			`{"multi_match":{"fields":["title","body"],"query":"#hashtag"}}`,
+		),
+	},
+	{name: "minus on free text", expr: `title == "x" && -admin`},
+	{name: "adjacent operands", expr: `"login page" admin title=="x"`},
+	{
+		name:    "flags",
+		expr:    `is_honeypot && !is_cdn`,
+		options: []Option{flagFields},
+		expected: must(
+			orMissing("is_honeypot", `{"term":{"is_honeypot":true}}`),
+			orMissing("is_cdn", `{"term":{"is_cdn":false}}`),
+		),
+		queried: []string{"is_cdn"},
+	},
+	// only the fields set by WithFlagFields are flags
+	{name: "field without comparison", expr: `title && is_honeypot`, options: []Option{flagFields}},
+	// in the search-box mode, words which aren't flags are still free text, even if they name a field
+	{
+		name:    "lenient flags",
+		expr:    `login is_honeypot port 80`,
+		options: searchBox,
+		expected: must(
+			must(
+				must(
+					`{"multi_match":{"fields":["title","body"],"query":"login"}}`,
+					orMissing("is_honeypot", `{"term":{"is_honeypot":true}}`),
+				),
+				`{"multi_match":{"fields":["title","body"],"query":"port"}}`,
+			),
+			`{"multi_match":{"fields":["title","body"],"query":80}}`,
+		),
+	},
+	{
+		name:    "field group",
+		expr:    `(title | body|header) == "login" && (ip|src) == 1.1.1.1 && (ip|src) != 2.2.2.2 && (is_honeypot || is_cdn)`,
+		options: []Option{flagFields},
+		expected: must(
+			must(
+				must(
+					should(
+						`{"multi_match":{"fields":["title","body","header"],"query":"login"}}`,
+						missing("title"), missing("body"), missing("header"),
+					),
+					should(
+						orMissing("ip", `{"range":{"ip":{"from":"1.1.1.1","include_lower":true,"include_upper":true,"to":"1.1.1.1"}}}`),
+						orMissing("src", `{"term":{"src":"1.1.1.1"}}`),
+					),
+				),
+				must(
+					orMissing("ip", mustNot(`{"range":{"ip":{"from":"2.2.2.2","include_lower":true,"include_upper":true,"to":"2.2.2.2"}}}`)),
+					orMissing("src", mustNot(`{"term":{"src":"2.2.2.2"}}`)),
+				),
+			),
+			should(
+				orMissing("is_honeypot", `{"term":{"is_honeypot":true}}`),
+				orMissing("is_cdn", `{"term":{"is_cdn":true}}`),
+			),
+		),
+		queried: []string{"header"},
+	},
+	// multi_match queries the fields by their name, rather than by their alias
+	{
+		name: "field group with aliases",
+		expr: `(organization|title) == "baidu"`,
+		expected: should(
+			`{"multi_match":{"fields":["org","title"],"query":"baidu"}}`,
+			missing("organization"), missing("title"),
+		),
+	},
+	{
+		name:    "lenient field group",
+		expr:    `login (title|body) == "x"`,
+		options: searchBox,
+		expected: must(
+			`{"multi_match":{"fields":["title","body"],"query":"login"}}`,
+			should(`{"multi_match":{"fields":["title","body"],"query":"x"}}`, missing("title"), missing("body")),
+		),
+	},
+	{
+		name:     "null",
+		expr:     `title == null || null != org`,
+		expected: should(missing("title"), `{"exists":{"field":"org"}}`),
+	},
+	// `null` is always a keyword, fields named like it are quoted
+	{name: "field named null", expr: `[null] == 1`, expected: orMissing("null", `{"term":{"null":1}}`)},
+	{
+		name:   "params",
+		expr:   `src == :ip && ts > $1 || src in :blocklist`,
+		params: Params{"ip": "1.1.1.1", "1": "now-1d", "blocklist": []string{"2.2.2.2"}},
+		expected: should(
+			must(
+				orMissing("src", `{"term":{"src":"1.1.1.1"}}`),
+				orMissing("ts", `{"range":{"ts":{"format":"yyyy-MM-dd","from":"now-1d","include_lower":false,"include_upper":true,"to":null}}}`),
+			),
+			orMissing("src", `{"terms":{"src":["2.2.2.2"]}}`),
+		),
+	},
+	{
+		name:     "params are values",
+		expr:     `src == :ip`,
+		params:   Params{"ip": `" || src != "`},
+		expected: orMissing("src", `{"term":{"src":"\" || src != \""}}`),
+	},
+	{
+		name: "spaced date math",
+		expr: `ts > now - 7d && ts < now/d + 36h`,
+		expected: must(
+			orMissing("ts", `{"range":{"ts":{"format":"yyyy-MM-dd","from":"now-7d","include_lower":false,"include_upper":true,"to":null}}}`),
+			orMissing("ts", `{"range":{"ts":{"format":"yyyy-MM-dd","from":null,"include_lower":true,"include_upper":false,"to":"now/d+36h"}}}`),
+		),
+	},
+	{name: "date math with milliseconds", expr: `ts > now - 10ms`},
+	{name: "date math times a number", expr: `ts > now * 2`},
+	{name: "unbound params", expr: `src == :ip && ts > $1`, params: Params{"ip": "1.1.1.1"}},
+	{
+		name: "field comparison",
+		expr: `bytes_out > bytes_in && updated_at != created_at`,
+		expected: must(
+			`{"script":{"script":{"lang":"painless","source":"doc['bytes_out'].size() == 0 || doc['bytes_in'].size() == 0 || doc['bytes_out'].value > doc['bytes_in'].value"}}}`,
+			`{"script":{"script":{"lang":"painless","source":"doc['updated'].size() == 0 || doc['updated'].value != doc['created'].value.toInstant().toEpochMilli()"}}}`,
+		),
+		queried: []string{"bytes_out", "bytes_in", "updated_at", "created_at"},
+	},
+	{name: "field comparison with unknown field", expr: `bytes_out > bytes_dropped`},
+	{name: "field comparison without script accessor", expr: `title == body`},
+	{
+		name: "arithmetic",
+		expr: `port == 8000 + 80 && size > 2 + 10 * 1024 && ts > "2022-01-01" + 3d - 12h*2`,
+		expected: must(
+			must(
+				orMissing("port", `{"range":{"port":{"from":8080,"include_lower":true,"include_upper":true,"to":8080}}}`),
+				orMissing("size", `{"range":{"size":{"from":10242,"include_lower":false,"include_upper":true,"to":null}}}`),
+			),
+			// quoted dates are parsed in the local time zone
+			orMissing("ts", fmt.Sprintf(`{"range":{"ts":{"format":"yyyy-MM-dd","from":%q,"include_lower":false,"include_upper":true,"to":null}}}`,
+				time.Date(2022, 1, 3, 0, 0, 0, 0, time.Local).Format(time.RFC3339Nano))),
+		),
+	},
+	// modifiers continue the operand rather than starting an implicitly ANDed one
+	{
+		name:    "lenient arithmetic",
+		expr:    `size > 10 - 2 port == 8000 + 80`,
+		options: searchBox,
+		expected: must(
+			orMissing("size", `{"range":{"size":{"from":8,"include_lower":false,"include_upper":true,"to":null}}}`),
+			orMissing("port", `{"range":{"port":{"from":8080,"include_lower":true,"include_upper":true,"to":8080}}}`),
+		),
+	},
+	{
+		name:   "integers",
+		expr:   `id == 9007199254740993 || id == 7 / 2 || delta == -(3 * 2) || delta == -:offset || delta in [-1, 1]`,
+		params: Params{"offset": uint8(4)},
+		expected: should(
+			should(
+				should(
+					should(
+						orMissing("id", `{"term":{"id":9007199254740993}}`),
+						orMissing("id", `{"term":{"id":3.5}}`),
+					),
+					orMissing("delta", `{"term":{"delta":-6}}`),
+				),
+				orMissing("delta", `{"term":{"delta":-4}}`),
+			),
+			orMissing("delta", `{"terms":{"delta":[-1,1]}}`),
+		),
+	},
+	{name: "integer overflow", expr: `id == 9223372036854775807 + 1`},
+	{
+		name: "units",
+		expr: `size > 10MB && latency >= 250ms && uptime < 3d - 12h && memory in [1mb, 1.5MB]`,
+		options: []Option{
+			WithDurationUnit("latency", time.Millisecond), WithDurationUnit("uptime", time.Hour), WithSizeUnit("memory", Kilobyte),
+		},
+		expected: must(
+			must(
+				must(
+					orMissing("size", `{"range":{"size":{"from":10485760,"include_lower":false,"include_upper":true,"to":null}}}`),
+					orMissing("latency", `{"range":{"latency":{"from":250,"include_lower":true,"include_upper":true,"to":null}}}`),
+				),
+				orMissing("uptime", `{"range":{"uptime":{"from":null,"include_lower":true,"include_upper":false,"to":60}}}`),
+			),
+			orMissing("memory", `{"terms":{"memory":[1024,1536]}}`),
+		),
+	},
+	{
+		name: "negative units",
+		expr: `size > -1MB && size > -(2KB + 1.5KB) && latency > -1.5s`,
+		expected: must(
+			must(
+				orMissing("size", `{"range":{"size":{"from":-1048576,"include_lower":false,"include_upper":true,"to":null}}}`),
+				orMissing("size", `{"range":{"size":{"from":-3584,"include_lower":false,"include_upper":true,"to":null}}}`),
+			),
+			orMissing("latency", `{"range":{"latency":{"from":-1500000000,"include_lower":false,"include_upper":true,"to":null}}}`),
+		),
+	},
+	{name: "size out of range", expr: `size > 8192PB`},
+	{name: "fractional size out of range", expr: `size > 8192.5PB`},
+	{name: "fractional bytes", expr: `size > 1.5B`},
+	{name: "fractional bytes of a larger unit", expr: `size > 0.1KB`},
+	{
+		name: "nested",
+		expr: `vulns[severity >= 7 && cve == "CVE-2021-44228"]`,
+		expected: `{"nested":{"path":"vulns","query":` + must(
+			orMissing("vulns.severity", `{"range":{"vulns.severity":{"from":7,"include_lower":true,"include_upper":true,"to":null}}}`),
+			orMissing("vulns.cve", `{"term":{"vulns.cve":"CVE-2021-44228"}}`),
+		) + `}}`,
+		queried: []string{"vulns.severity", "vulns.cve"},
+	},
+	{name: "mismatched brackets", expr: `vulns[cve == "x")`},
+	{
+		name: "ip",
+		expr: `src == 10.0.0.0/8 || src in [2001:db8::1, ::1, fe80::1] || ip == 1.1.1.1-1.1.1.9 || 10.0.0.1 < ip`,
+		expected: should(
+			should(
+				should(
+					orMissing("src", `{"term":{"src":"10.0.0.0/8"}}`),
+					orMissing("src", `{"terms":{"src":["2001:db8::1","::1","fe80::1"]}}`),
+				),
+				orMissing("ip", `{"range":{"ip":{"from":"1.1.1.1","include_lower":true,"include_upper":true,"to":"1.1.1.9"}}}`),
+			),
+			orMissing("ip", `{"range":{"ip":{"from":"10.0.0.1","include_lower":false,"include_upper":true,"to":null}}}`),
+		),
+	},
+}
+
+func TestQueryBuilder_BuildCases(t *testing.T) {
+	for _, test := range buildTests {
+		t.Run(test.name, func(t *testing.T) {
+			qb, err := NewQueryBuilder(test.expr, testFactory(), test.options...)
+			var query elastic.Query
+			var queried map[string]bool
+			if err == nil {
+				query, queried, err = qb.Build(test.params)
+			}
+			if test.expected == "" {
+				if err == nil {
+					t.Fatalf("%s accepted", test.expr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertQuery(t, query, test.expected)
+			for _, field := range test.queried {
+				if !queried[field] {
+					t.Fatalf("%s not queried: %v", field, queried)
+				}
+			}
+		})
+	}
+}
+
+// a field group compares each field as on its own, including for documents missing some of the fields
+func TestQueryBuilder_BuildFieldGroupExpansion(t *testing.T) {
+	for group, expansion := range map[string]string{
+		`(ip|src) == 1.1.1.1`:         `ip == 1.1.1.1 || src == 1.1.1.1`,
+		`(ip|src) != 1.1.1.1`:         `ip != 1.1.1.1 && src != 1.1.1.1`,
+		`(title|src) in ["a", "b"]`:   `title in ["a", "b"] || src in ["a", "b"]`,
+		`(title|body) == null`:        `title == null || body == null`,
+		`(title|host) startswith "a"`: `title startswith "a" || host startswith "a"`,
+	} {
+		query, _, err := buildTestQuery(group)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, _, err := buildTestQuery(expansion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		source, _ := expected.Source()
+		data, _ := json.Marshal(source)
+		assertQuery(t, query, string(data))
+	}
+}
+
+func buildTestQuery(expr string) (elastic.Query, map[string]bool, error) {
+	qb, err := NewQueryBuilder(expr, testFactory())
+	if err != nil {
+		return nil, nil, err
+	}
+	return qb.Build()
+}
+
+// generators may hand out the same query for every call, chained comparisons mustn't modify it
+func TestQueryBuilder_BuildChainedComparisonCopiesRange(t *testing.T) {
+	lower := elastic.NewRangeQuery("port").Gte(1024)
+	factory := map[string]map[Operator]QueryGenerator{
+		"port": {
+			GTE: func(value interface{}) elastic.Query {
+				return lower
+			},
+		},
+	}
+	qb, err := NewQueryBuilder(`1024 <= port < 65535 || 1024 <= port`, factory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, _, err := qb.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertQuery(t, query, should(
+		orMissing("port", `{"range":{"port":{"from":1024,"include_lower":true,"include_upper":false,"to":65535}}}`),
+		orMissing("port", `{"range":{"port":{"from":1024,"include_lower":true,"include_upper":true,"to":null}}}`),
+	))
+}
+
+func TestQueryBuilder_BuildBoostCopiesQuery(t *testing.T) {
+	shared := elastic.NewTermQuery("port", 1)
+	factory := map[string]map[Operator]QueryGenerator{
+		"port": {
+			EQ: func(value interface{}) elastic.Query {
+				return shared
+			},
+		},
+	}
+	qb, err := NewQueryBuilder(`port == 1^5 || port == 1`, factory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, _, err := qb.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertQuery(t, query, should(
+		orMissing("port", `{"term":{"port":{"boost":5,"value":1}}}`),
+		orMissing("port", `{"term":{"port":1}}`),
+	))
+}
+
+func must(queries ...string) string {
+	return `{"bool":{"must":[` + strings.Join(queries, ",") + `]}}`
+}
+
+func should(queries ...string) string {
+	return `{"bool":{"should":[` + strings.Join(queries, ",") + `]}}`
+}
+
+func mustNot(query string) string {
+	return `{"bool":{"must_not":` + query + `}}`
+}
+
+func missing(field string) string {
+	return mustNot(`{"exists":{"field":"` + field + `"}}`)
+}
+
+// orMissing is how a comparison on a field also matches the documents missing it
+func orMissing(field, query string) string {
+	return should(query, missing(field))
+}
+
+// assertQuery compares the query with the expected JSON once both are decoded, so key order and spacing don't matter
+func assertQuery(t *testing.T, query elastic.Query, expected string) {
+	t.Helper()
+	source, err := query.Source()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decodeJSON(t, data), decodeJSON(t, []byte(expected))) {
+		t.Fatalf("expected %s, got %s", expected, data)
+	}
+}
+
+// decodeJSON keeps numbers as json.Number, so integers and floats are told apart and large IDs keep their precision
+func decodeJSON(t *testing.T, data []byte) interface{} {
+	t.Helper()
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestQueryBuilder_Comments(t *testing.T) {
+	expr := "ip in [1.1.1.1] /* blocklist */ && size == 4096 / 2 // half a page\n# owned by the SOC team"
+	qb, err := NewQueryBuilder(expr, testFactory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = qb.Build(); err != nil {
+		t.Fatal(err)
+	}
+	comments := qb.Comments()
+	if len(comments) != 3 || comments[0].Text != " blocklist " || comments[2].Text != " owned by the SOC team" {
+		t.Fatalf("unexpected comments %v", comments)
+	}
+	if span := string([]rune(expr)[comments[1].Start:comments[1].End]); span != "// half a page" {
+		t.Fatalf("unexpected comment span %q", span)
+	}
+}
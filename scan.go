@@ -4,12 +4,37 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"math"
 	"strconv"
+	"strings"
 	"time"
 	"unicode"
+	"unicode/utf8"
 )
 
-func scanTokens(expression string) ([]expressionToken, error) {
+/*
+	Lexer settings, configured through the Options of a queryBuilder.
+*/
+type scanOptions struct {
+	// lower-cased words which are synonyms of operator symbols, e.g. "and" for "&&"
+	wordOperators map[string]string
+	// whether adjacent operands are implicitly ANDed
+	lenient bool
+}
+
+var defaultWordOperators = map[string]string{
+	"and": "&&",
+	"or":  "||",
+	"not": "!",
+}
+
+func defaultScanOptions() scanOptions {
+	return scanOptions{
+		wordOperators: defaultWordOperators,
+	}
+}
+
+func scanTokens(expression string, options scanOptions) ([]expressionToken, error) {
 
 	var ret []expressionToken
 	var token expressionToken
@@ -23,7 +48,7 @@ func scanTokens(expression string) ([]expressionToken, error) {
 
 	for stream.canRead() {
 
-		token, err, found = readToken(stream, state)
+		token, err, found = readToken(stream, state, options)
 
 		if err != nil {
 			return ret, err
@@ -33,6 +58,17 @@ func scanTokens(expression string) ([]expressionToken, error) {
 			break
 		}
 
+		// comments don't take part in the syntax
+		if token.Kind == commentToken {
+			ret = append(ret, token)
+			continue
+		}
+
+		// in lenient mode, adjacent operands are implicitly ANDed, e.g. `login page`
+		if options.lenient && state.isEOF && startsOperand(token.Kind) {
+			ret = append(ret, expressionToken{Kind: logicalToken, Value: "&&"})
+		}
+
 		state, err = getLexerStateForToken(token.Kind)
 		if err != nil {
 			return ret, err
@@ -57,15 +93,16 @@ func scanTokens(expression string) ([]expressionToken, error) {
 	return ret, nil
 }
 
-func readToken(stream *lexerStream, state lexerState) (expressionToken, error, bool) {
+func readToken(stream *lexerStream, state lexerState, options scanOptions) (expressionToken, error, bool) {
 	var ret expressionToken
 	var tokenValue interface{}
 	var tokenTime time.Time
 	var tokenString string
+	var symbol string
 	var kind tokenKind
 	var character rune
 	var found bool
-	var completed bool
+	var glued bool
 	var err error
 
 	// numericToken is 0-9, or . or 0x followed by digits
@@ -82,50 +119,93 @@ func readToken(stream *lexerStream, state lexerState) (expressionToken, error, b
 			continue
 		}
 
-		kind = unknownToken
-
-		// numericToken constant
-		if isNumeric(character) {
-
-			if stream.canRead() && character == '0' {
-				character = stream.readCharacter()
+		if character == '\\' && !stream.canRead() {
+			return expressionToken{}, errors.New("Dangling '\\' at the end of the expression"), false
+		}
 
-				if stream.canRead() && character == 'x' {
-					tokenString, _ = readUntilFalse(stream, false, true, true, isHexDigit)
-					tokenValueInt, err := strconv.ParseUint(tokenString, 16, 64)
+		kind = unknownToken
 
-					if err != nil {
-						errorMsg := fmt.Sprintf("Unable to parse hex value '%v' to uint64\n", tokenString)
-						return expressionToken{}, errors.New(errorMsg), false
-					}
+		// unquoted IP, CIDR or IP range, e.g. `10.0.0.0/8` or `2001:db8::1`
+		if startsIP(stream, character) {
 
-					kind = numericToken
-					tokenValue = float64(tokenValueInt)
-					break
-				} else {
-					stream.rewind(1)
-				}
+			stream.rewind(1)
+			tokenValue, kind, found = readIP(stream)
+			if found {
+				break
 			}
+			character = stream.readCharacter()
+		}
 
-			tokenString = readTokenUntilFalse(stream, isNumeric)
-			tokenValue, err = strconv.ParseFloat(tokenString, 64)
+		// numericToken constant
+		if isNumeric(character) {
 
+			tokenValue, kind, err = readNumber(stream, character)
 			if err != nil {
-				errorMsg := fmt.Sprintf("Unable to parse numericToken value '%v' to float64\n", tokenString)
-				return expressionToken{}, errors.New(errorMsg), false
+				return expressionToken{}, err, false
 			}
-			kind = numericToken
 			break
 		}
 
-		// regular variable - or function?
-		if unicode.IsLetter(character) {
+		// regular variable - or function? `@` starts names such as `@timestamp`
+		// in lenient mode, `#` is part of words such as `C#` or `#hashtag` instead of starting a comment
+		if unicode.IsLetter(character) || character == '@' || options.lenient && character == '#' {
+
+			isName := isVariableName
+			if options.lenient {
+				isName = isSearchWord
+			}
+			tokenString, glued = readGluedTokenUntilFalse(stream, isName)
+
+			// in lenient mode, a hyphenated word is a single word, e.g. `e-mail`, rather than a subtraction
+			for options.lenient && glued && continuesHyphenated(stream) {
 
-			tokenString = readTokenUntilFalse(stream, isVariableName)
+				var rest string
+
+				stream.readCharacter()
+				stream.readCharacter()
+				rest, glued = readGluedTokenUntilFalse(stream, isName)
+				tokenString += "-" + rest
+			}
 
 			tokenValue = tokenString
 			kind = variableToken
 
+			// `not in` is checked first, as `not` after an operand is otherwise an implicitly ANDed prefix in lenient mode
+			if state.canTransitionTo(compareToken) && strings.EqualFold(tokenString, "not") && readKeyword(stream, "in") {
+				kind = compareToken
+				tokenValue = "not in"
+				break
+			}
+
+			// word operators are only operators where such an operator is expected,
+			// so that fields with those names can still be referenced.
+			symbol, found = options.wordOperators[strings.ToLower(tokenString)]
+			if found {
+
+				kind = wordOperatorKind(symbol, state, options)
+				if kind != variableToken {
+					tokenValue = symbol
+					if kind == prefixToken && symbol == "!" {
+						// unlike `!`, the word negates the whole comparison after it, e.g. `not title == "x"`
+						tokenValue = "not"
+					}
+					break
+				}
+			}
+
+			// word comparators such as "in" and "like" are only comparators where a comparator is expected,
+			// so that fields with those names can still be referenced.
+			if state.canTransitionTo(compareToken) {
+
+				// like the word operators, they are case-insensitive, e.g. `title NOT IN ["a"]`
+				_, found = comparatorSymbols[strings.ToLower(tokenString)]
+				if found {
+					kind = compareToken
+					tokenValue = strings.ToLower(tokenString)
+					break
+				}
+			}
+
 			// booleanToken?
 			if tokenValue == "true" {
 
@@ -139,18 +219,65 @@ func readToken(stream *lexerStream, state lexerState) (expressionToken, error, b
 					tokenValue = false
 				}
 			}
+
+			if tokenValue == "null" {
+
+				kind = nullToken
+				tokenValue = nil
+			}
+
+			// relative date, passed through as elasticsearch date-math, e.g. `now-7d/d`.
+			// A bare `now` is only a date where a value is expected, so that a field can be named `now`.
+			if tokenValue == "now" {
+
+				tokenString = ""
+				if glued {
+
+					tokenString, err = readDateMath(stream)
+					if err != nil {
+						return expressionToken{}, err, false
+					}
+				}
+				if tokenString != "" || state.kind == compareToken || state.kind == modifierToken {
+
+					kind = dateMathToken
+					tokenValue = "now" + tokenString
+				}
+			}
+
+			// function call, or nested sub-expression such as `vulns[severity >= 7]`?
+			// In lenient mode they must be glued to the name, as `login (title|body) == "x"` is two operands.
+			if kind == variableToken && stream.canRead() && (glued || !options.lenient) {
+
+				character = stream.readCharacter()
+				if character == '(' {
+					kind = functionToken
+				} else if character == '[' {
+					kind = nestedToken
+				} else {
+					stream.rewind(1)
+				}
+			}
 			break
 		}
 
-		if !isNotQuote(character) {
-			tokenValue, completed = readUntilFalse(stream, true, false, true, isNotQuote)
+		// raw string, without escape sequences, e.g. `\d+\.cn`
+		if character == '`' {
+			tokenValue, err = readString(stream, character, true)
 
-			if !completed {
-				return expressionToken{}, errors.New("Unclosed string literal"), false
+			if err != nil {
+				return expressionToken{}, err, false
 			}
+			kind = stringToken
+			break
+		}
+
+		if !isNotQuote(character) {
+			tokenValue, err = readString(stream, character, false)
 
-			// advance the stream one position, since reading until false assumes the terminator is a real token
-			stream.rewind(-1)
+			if err != nil {
+				return expressionToken{}, err, false
+			}
 
 			// check to see if this can be parsed as a time.
 			tokenTime, found = tryParseTime(tokenValue.(string))
@@ -163,20 +290,117 @@ func readToken(stream *lexerStream, state lexerState) (expressionToken, error, b
 			break
 		}
 
+		// placeholder bound at build time, e.g. `:ip` or `$1`
+		if character == ':' || character == '$' {
+			tokenString, _ = readUntilFalse(stream, true, false, false, isVariableName)
+
+			if tokenString == "" {
+				errorMessage := fmt.Sprintf("Missing placeholder name after '%c'", character)
+				return expressionToken{}, errors.New(errorMessage), false
+			}
+			tokenValue = tokenString
+			kind = placeholderToken
+			break
+		}
+
+		// boost of the preceding comparison or group, e.g. `title == "login"^3`
+		if character == '^' {
+			tokenString, _ = readUntilFalse(stream, false, true, false, isNumeric)
+			if tokenString == "" {
+				return expressionToken{}, errors.New("Missing boost after '^'"), false
+			}
+
+			tokenValue, err = strconv.ParseFloat(tokenString, 64)
+			if err != nil {
+				errorMsg := fmt.Sprintf("Unable to parse boost value '%v' to float64\n", tokenString)
+				return expressionToken{}, errors.New(errorMsg), false
+			}
+			kind = boostToken
+			break
+		}
+
+		// quoted field where a list can't appear, e.g. `[http.response-code] >= 500`.
+		// It's never a keyword and may contain any character, backslashes escape characters as in strings.
+		if character == '[' && !state.canTransitionTo(arrayToken) {
+			tokenString, err = readString(stream, ']', false)
+
+			if err != nil {
+				return expressionToken{}, fmt.Errorf("Invalid quoted field: %v", err), false
+			}
+			if tokenString == "" {
+				return expressionToken{}, errors.New("Empty quoted field"), false
+			}
+			tokenValue = tokenString
+			kind = variableToken
+
+			// nested sub-expression, e.g. `[http-logs][status >= 500]`
+			if stream.canRead() {
+
+				character = stream.readCharacter()
+				if character == '[' {
+					kind = nestedToken
+				} else {
+					stream.rewind(1)
+				}
+			}
+			break
+		}
+
+		if character == '[' {
+			tokenValue, err = readArray(stream, options)
+
+			if err != nil {
+				return expressionToken{}, err, false
+			}
+			kind = arrayToken
+			break
+		}
+
+		if character == ',' {
+			tokenValue = character
+			kind = separatorToken
+			break
+		}
+
 		if character == '(' {
+
+			// group of fields compared at once, e.g. `(title|body) == "login"`,
+			// also starting an implicitly ANDed operand in lenient mode, e.g. `login (title|body) == "x"`
+			if state.canTransitionTo(fieldGroupToken) || options.lenient && state.isEOF {
+
+				tokenValue, found = readFieldGroup(stream)
+				if found {
+					kind = fieldGroupToken
+					break
+				}
+			}
+
 			tokenValue = character
 			kind = clauseToken
 			break
 		}
 
-		if character == ')' {
+		if character == ')' || character == ']' {
 			tokenValue = character
 			kind = clauseCloseToken
 			break
 		}
 
+		// comment, kept with its span so that the expression can be formatted without losing it
+		if !options.lenient && character == '#' || character == '/' && stream.canRead() {
+
+			tokenValue, found, err = readComment(stream, character)
+			if err != nil {
+				return expressionToken{}, err, false
+			}
+			if found {
+				kind = commentToken
+				break
+			}
+		}
+
 		// must be a known symbol
-		tokenString = readTokenUntilFalse(stream, isNotAlphanumeric)
+		tokenString = readSymbol(stream)
 		tokenValue = tokenString
 
 		// quick hack for the case where "-" can mean "prefixed negation" or "minus", which are used
@@ -185,11 +409,50 @@ func readToken(stream *lexerStream, state lexerState) (expressionToken, error, b
 			_, found = prefixSymbols[tokenString]
 			if found {
 
+				// negative number, e.g. `-5` or `[-1, 1]`
+				if tokenString == "-" && stream.canRead() {
+
+					character = stream.readCharacter()
+					if isDigit(character) {
+
+						tokenValue, kind, err = readNumber(stream, character)
+						if err == nil {
+							tokenValue, err = negateNumber(tokenValue)
+						}
+						if err != nil {
+							return expressionToken{}, err, false
+						}
+						break
+					}
+					stream.rewind(1)
+				}
+
+				kind = prefixToken
+				break
+			}
+		}
+
+		// in lenient mode, a `-` glued to a word excludes it, e.g. `login -admin`,
+		// as words can't be subtracted. `size > 10 -2` stays arithmetic,
+		// and a `-` inside a word doesn't exclude anything, e.g. `e-mail`.
+		if options.lenient && state.isEOF && tokenString == "-" && stream.canRead() && startsWord(stream) {
+
+			character = stream.readCharacter()
+			stream.rewind(1)
+			if unicode.IsLetter(character) || character == '@' {
+
 				kind = prefixToken
 				break
 			}
 		}
 
+		_, found = modifierSymbols[tokenString]
+		if found {
+
+			kind = modifierToken
+			break
+		}
+
 		_, found = logicalSymbols[tokenString]
 		if found {
 
@@ -201,9 +464,29 @@ func readToken(stream *lexerStream, state lexerState) (expressionToken, error, b
 		if found {
 
 			kind = compareToken
+
+			// edit distance of a fuzzy comparison, in parentheses right after the operator, e.g. `~=(2)`
+			if tokenString == "~=" {
+
+				tokenString, err = readFuzziness(stream)
+				if err != nil {
+					return ret, err, false
+				}
+				tokenValue = "~=" + tokenString
+			}
 			break
 		}
 
+		// in lenient mode, a prefix right after a value starts an implicitly ANDed operand.
+		if options.lenient && state.isEOF {
+			_, found = prefixSymbols[tokenString]
+			if found {
+
+				kind = prefixToken
+				break
+			}
+		}
+
 		errorMessage := fmt.Sprintf("Invalid token: '%s'", tokenString)
 		return ret, errors.New(errorMessage), false
 	}
@@ -214,6 +497,141 @@ func readToken(stream *lexerStream, state lexerState) (expressionToken, error, b
 	return ret, nil, kind != unknownToken
 }
 
+/*
+	Reads a number, assuming its first character was already consumed.
+	Integers are kept as int64, or uint64 if they don't fit, so that large IDs don't lose precision.
+	Numbers with a fraction or an exponent, such as "1.5" or "1e6", are float64.
+	A unit directly following the number makes it a duration or a size, e.g. "3d" or "10MB".
+*/
+func readNumber(stream *lexerStream, character rune) (interface{}, tokenKind, error) {
+
+	var tokenString string
+	var value interface{}
+	var unit int64
+	var kind tokenKind
+	var found bool
+	var glued bool
+	var err error
+
+	if stream.canRead() && character == '0' {
+		character = stream.readCharacter()
+
+		if stream.canRead() && character == 'x' {
+			tokenString, _ = readUntilFalse(stream, false, true, true, isHexDigit)
+			value, err = parseInteger(tokenString, 16)
+
+			if err != nil {
+				errorMsg := fmt.Sprintf("Unable to parse hex value '%v' to uint64\n", tokenString)
+				return nil, unknownToken, errors.New(errorMsg)
+			}
+			return value, numericToken, nil
+		} else {
+			stream.rewind(1)
+		}
+	}
+
+	tokenString, glued = readGluedTokenUntilFalse(stream, isNumeric)
+	if glued {
+		tokenString += readExponent(stream)
+	}
+
+	if strings.ContainsAny(tokenString, ".eE") {
+		value, err = strconv.ParseFloat(tokenString, 64)
+	} else {
+		value, err = parseInteger(tokenString, 10)
+	}
+	if err != nil {
+		errorMsg := fmt.Sprintf("Unable to parse numericToken value '%v'\n", tokenString)
+		return nil, unknownToken, errors.New(errorMsg)
+	}
+
+	// duration or size? the unit must directly follow the number, e.g. `3d` or `10MB`
+	if glued {
+
+		unit, kind, found = readUnit(stream)
+		if found {
+			switch number := value.(type) {
+			case float64:
+				// float64(math.MaxInt64) rounds up to 2^63, which doesn't fit
+				product := number * float64(unit)
+				if kind == sizeToken && product != math.Trunc(product) {
+					return nil, unknownToken, fmt.Errorf("Size '%v' is not a whole number of bytes", tokenString)
+				}
+				if product < math.MaxInt64 {
+					return quantityValue(kind, int64(product)), kind, nil
+				}
+			case int64:
+				if number == 0 || number*unit/number == unit {
+					return quantityValue(kind, number*unit), kind, nil
+				}
+			}
+			return nil, unknownToken, fmt.Errorf("Quantity '%v' is out of range", tokenString)
+		}
+	}
+	return value, numericToken, nil
+}
+
+/*
+	Parses an integer to int64, or to uint64 if it's too large for int64.
+*/
+func parseInteger(tokenString string, base int) (interface{}, error) {
+
+	value, err := strconv.ParseUint(tokenString, base, 64)
+	if err != nil {
+		return nil, err
+	}
+	if value > math.MaxInt64 {
+		return value, nil
+	}
+	return int64(value), nil
+}
+
+/*
+	Reads the exponent of a number, such as "e6" or "E-3".
+	Leaves the stream untouched and returns an empty string if there is no exponent.
+*/
+func readExponent(stream *lexerStream) string {
+
+	var exponent []rune
+	var character rune
+	var digits int
+
+	if !stream.canRead() {
+		return ""
+	}
+	character = stream.readCharacter()
+	if character != 'e' && character != 'E' {
+		stream.rewind(1)
+		return ""
+	}
+	exponent = append(exponent, character)
+
+	if stream.canRead() {
+		character = stream.readCharacter()
+		if character == '+' || character == '-' {
+			exponent = append(exponent, character)
+		} else {
+			stream.rewind(1)
+		}
+	}
+
+	for stream.canRead() {
+		character = stream.readCharacter()
+		if !isDigit(character) {
+			stream.rewind(1)
+			break
+		}
+		exponent = append(exponent, character)
+		digits++
+	}
+
+	if digits == 0 {
+		stream.rewind(len(exponent))
+		return ""
+	}
+	return string(exponent)
+}
+
 func readTokenUntilFalse(stream *lexerStream, condition func(rune) bool) string {
 
 	var ret string
@@ -223,6 +641,20 @@ func readTokenUntilFalse(stream *lexerStream, condition func(rune) bool) string
 	return ret
 }
 
+/*
+	Like readTokenUntilFalse, but also returns whether the next character directly follows the token,
+	as in `now-1d` or `10MB`, rather than being separated from it by whitespace.
+*/
+func readGluedTokenUntilFalse(stream *lexerStream, condition func(rune) bool) (string, bool) {
+
+	var ret string
+	var start int
+
+	start = stream.position - 1
+	ret = readTokenUntilFalse(stream, condition)
+	return ret, stream.canRead() && stream.position == start+utf8.RuneCountInString(ret)
+}
+
 /*
 	Returns the string that was read until the given [condition] was false, or whitespace was broken.
 	Returns false if the stream ended before whitespace was broken or condition was met.
@@ -242,6 +674,11 @@ func readUntilFalse(stream *lexerStream, includeWhitespace bool, breakWhitespace
 		// Use backslashes to escape anything
 		if allowEscaping && character == '\\' {
 
+			// a dangling backslash escapes nothing, leave it to be rejected by the lexer
+			if !stream.canRead() {
+				stream.rewind(1)
+				break
+			}
 			character = stream.readCharacter()
 			tokenBuffer.WriteString(string(character))
 			continue
@@ -270,6 +707,404 @@ func readUntilFalse(stream *lexerStream, includeWhitespace bool, breakWhitespace
 	return tokenBuffer.String(), conditioned
 }
 
+/*
+	Reads a line comment starting with "#" or "//", or a block comment between "/*" and "*" + "/",
+	assuming its first character was already consumed.
+	Leaves the stream untouched and returns false if the character doesn't start a comment.
+*/
+func readComment(stream *lexerStream, character rune) (Comment, bool, error) {
+
+	var ret Comment
+	var buffer bytes.Buffer
+	var block bool
+
+	ret.Start = stream.position - 1
+
+	if character == '/' {
+
+		character = stream.readCharacter()
+		if character != '/' && character != '*' {
+			stream.rewind(1)
+			return ret, false, nil
+		}
+		block = character == '*'
+	}
+
+	for stream.canRead() {
+
+		character = stream.readCharacter()
+
+		if block && character == '*' && stream.canRead() {
+
+			if stream.readCharacter() == '/' {
+				ret.Text = buffer.String()
+				ret.End = stream.position
+				return ret, true, nil
+			}
+			stream.rewind(1)
+		}
+
+		if !block && character == '\n' {
+			stream.rewind(1)
+			break
+		}
+		buffer.WriteRune(character)
+	}
+
+	if block {
+		return ret, false, errors.New("Unclosed comment")
+	}
+
+	ret.Text = buffer.String()
+	ret.End = stream.position
+	return ret, true, nil
+}
+
+/*
+	Reads a string literal until the given quote, assuming the opening quote was already consumed.
+	Unless the string is raw, backslashes start the escape sequences \n, \r, \t, \uXXXX
+	and escape any other character, such as the quote itself.
+*/
+func readString(stream *lexerStream, quote rune, raw bool) (string, error) {
+
+	var buffer bytes.Buffer
+	var character rune
+	var code string
+	var value uint64
+	var err error
+
+	for stream.canRead() {
+
+		character = stream.readCharacter()
+
+		if character == quote {
+			return buffer.String(), nil
+		}
+
+		if raw || character != '\\' {
+			buffer.WriteRune(character)
+			continue
+		}
+
+		if !stream.canRead() {
+			break
+		}
+
+		character = stream.readCharacter()
+		switch character {
+		case 'n':
+			buffer.WriteRune('\n')
+		case 'r':
+			buffer.WriteRune('\r')
+		case 't':
+			buffer.WriteRune('\t')
+		case 'u':
+			code = ""
+			for len(code) < 4 && stream.canRead() {
+				code += string(stream.readCharacter())
+			}
+
+			value, err = strconv.ParseUint(code, 16, 32)
+			if err != nil || len(code) < 4 {
+				return "", fmt.Errorf("Invalid escape sequence '\\u%s'", code)
+			}
+			buffer.WriteRune(rune(value))
+		default:
+			buffer.WriteRune(character)
+		}
+	}
+
+	return "", errors.New("Unclosed string literal")
+}
+
+/*
+	Reads the elements of an array literal, assuming the opening '[' was already consumed.
+	Elements are comma-separated literals, nested expressions are not allowed.
+*/
+func readArray(stream *lexerStream, options scanOptions) ([]interface{}, error) {
+
+	var ret []interface{}
+	var token expressionToken
+	var character rune
+	var err error
+	var found bool
+
+	ret = []interface{}{}
+
+	for {
+
+		if !skipWhitespace(stream) {
+			return nil, errors.New("Unclosed array literal")
+		}
+
+		character = stream.readCharacter()
+		if character == ']' {
+
+			if len(ret) > 0 {
+				return nil, errors.New("Missing array element after ','")
+			}
+			return ret, nil
+		}
+		stream.rewind(1)
+
+		token, err, found = readToken(stream, validLexerStates[0], options)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, errors.New("Unclosed array literal")
+		}
+		// elements are values, so a bare `now` is a date rather than a field
+		if token.Kind == variableToken && token.Value == "now" {
+			token = expressionToken{Kind: dateMathToken, Value: "now"}
+		}
+		if !isLiteral(token.Kind) {
+			return nil, fmt.Errorf("Invalid array element '%v'", token.Value)
+		}
+		ret = append(ret, token.Value)
+
+		if !skipWhitespace(stream) {
+			return nil, errors.New("Unclosed array literal")
+		}
+
+		character = stream.readCharacter()
+		if character == ']' {
+			return ret, nil
+		}
+		if character != ',' {
+			return nil, fmt.Errorf("Expected ',' or ']' in array literal, found '%c'", character)
+		}
+	}
+}
+
+/*
+	Reads the edit distance of a fuzzy comparison, such as "2" in `~=2` or `~=(2)`, assuming "~=" was already consumed.
+	Returns an empty string if no distance follows. The distance must directly follow "~=",
+	as `~= 2` is a fuzzy comparison with the number 2.
+*/
+func readFuzziness(stream *lexerStream) (string, error) {
+
+	var start int
+	var character rune
+	var distance string
+
+	start = stream.position
+	if !stream.canRead() {
+		return "", nil
+	}
+
+	character = stream.readCharacter()
+	if isDigit(character) {
+
+		distance = readTokenUntilFalse(stream, isDigit)
+		if distance != "0" && distance != "1" && distance != "2" {
+			return "", fmt.Errorf("Invalid fuzziness in '~=%s', should be 0, 1 or 2", distance)
+		}
+		return distance, nil
+	}
+	if character == '(' {
+
+		distance, _ = readUntilFalse(stream, false, false, false, isDigit)
+		if distance != "" && stream.canRead() && stream.readCharacter() == ')' {
+
+			if distance != "0" && distance != "1" && distance != "2" {
+				return "", fmt.Errorf("Invalid fuzziness in '~=(%s)', should be 0, 1 or 2", distance)
+			}
+			return distance, nil
+		}
+	}
+
+	// not a distance, e.g. `~= "x"` or `~=("x")`
+	stream.rewind(stream.position - start)
+	return "", nil
+}
+
+/*
+	Reads the date-math operations following `now`, such as "-1d/d".
+	Each operation is "+" or "-" followed by an amount and a unit, or "/" followed by a unit to round to.
+*/
+func readDateMath(stream *lexerStream) (string, error) {
+
+	var buffer bytes.Buffer
+	var character rune
+	var amount string
+
+	for stream.canRead() {
+
+		character = stream.readCharacter()
+		if character != '+' && character != '-' && character != '/' {
+			stream.rewind(1)
+			break
+		}
+		buffer.WriteRune(character)
+
+		if character != '/' {
+			amount, _ = readUntilFalse(stream, true, false, false, isDigit)
+			if amount == "" {
+				return "", fmt.Errorf("Missing amount in date-math 'now%s'", buffer.String())
+			}
+			buffer.WriteString(amount)
+		}
+
+		if !stream.canRead() {
+			return "", fmt.Errorf("Missing unit in date-math 'now%s'", buffer.String())
+		}
+		character = stream.readCharacter()
+		if !isDateMathUnit(character) {
+			return "", fmt.Errorf("Invalid unit '%c' in date-math 'now%s'", character, buffer.String())
+		}
+		buffer.WriteRune(character)
+	}
+
+	return buffer.String(), nil
+}
+
+/*
+	Reads the unit of a duration or size literal, such as "ms" in `250ms` or "MB" in `10MB`.
+	Returns the unit in nanoseconds or bytes, and the kind of the literal.
+	Leaves the stream untouched and returns false if no unit follows.
+*/
+func readUnit(stream *lexerStream) (int64, tokenKind, bool) {
+
+	var word string
+
+	word, _ = readUntilFalse(stream, true, false, false, unicode.IsLetter)
+
+	if duration, found := durationUnits[word]; found {
+		return int64(duration), durationToken, true
+	}
+	if size, found := sizeUnits[strings.ToLower(word)]; found {
+		return int64(size), sizeToken, true
+	}
+	stream.rewind(len([]rune(word)))
+	return 0, unknownToken, false
+}
+
+var durationUnits = map[string]time.Duration{
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+}
+
+/*
+	Skips whitespace in the stream.
+	Returns false if the stream ended before a non-whitespace character was found.
+*/
+func skipWhitespace(stream *lexerStream) bool {
+
+	for stream.canRead() {
+
+		if !unicode.IsSpace(stream.readCharacter()) {
+			stream.rewind(1)
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Reads a group of at least two fields separated by '|', such as "(title|body)",
+	assuming the opening '(' was already consumed. Fields are bare or quoted with brackets, e.g. "(title|[http-body])".
+	Leaves the stream untouched and returns false if the parenthesis doesn't start a field group.
+*/
+func readFieldGroup(stream *lexerStream) ([]string, bool) {
+
+	var fields []string
+	var field string
+	var character rune
+	var err error
+	start := stream.position
+
+	for skipWhitespace(stream) {
+
+		character = stream.readCharacter()
+		if character == '[' {
+
+			field, err = readString(stream, ']', false)
+			if err != nil || field == "" {
+				break
+			}
+		} else if unicode.IsLetter(character) || character == '@' {
+
+			field = readTokenUntilFalse(stream, isVariableName)
+		} else {
+			break
+		}
+		fields = append(fields, field)
+
+		if !skipWhitespace(stream) {
+			break
+		}
+		character = stream.readCharacter()
+		if character == ')' && len(fields) > 1 {
+			return fields, true
+		}
+		if character != '|' {
+			break
+		}
+	}
+
+	stream.rewind(stream.position - start)
+	return nil, false
+}
+
+/*
+	Attempts to read the given keyword as the next word of the stream, in any case.
+	Leaves the stream untouched and returns false if the next word is something else.
+*/
+func readKeyword(stream *lexerStream, keyword string) bool {
+
+	var start int
+	var word string
+
+	start = stream.position
+	skipWhitespace(stream)
+
+	word, _ = readUntilFalse(stream, false, true, false, isVariableName)
+	if strings.EqualFold(word, keyword) {
+		return true
+	}
+
+	stream.rewind(stream.position - start)
+	return false
+}
+
+/*
+	Reads the longest known symbol from the stream, so that adjacent symbols such as "&&!" are split
+	into separate tokens. If no known symbol matches, the whole run of symbol characters is returned.
+*/
+func readSymbol(stream *lexerStream) string {
+
+	var symbol []rune
+	var character rune
+
+	stream.rewind(1)
+
+	for stream.canRead() {
+
+		character = stream.readCharacter()
+
+		if unicode.IsSpace(character) || !isNotAlphanumeric(character) {
+			stream.rewind(1)
+			break
+		}
+		symbol = append(symbol, character)
+	}
+
+	for length := len(symbol); length > 0; length-- {
+
+		if isKnownSymbol(string(symbol[:length])) {
+			stream.rewind(len(symbol) - length)
+			return string(symbol[:length])
+		}
+	}
+
+	return string(symbol)
+}
+
 /*
 	Checks the balance of tokens which have multiple parts, such as parenthesis.
 */
@@ -277,29 +1112,119 @@ func checkBalance(tokens []expressionToken) error {
 
 	var stream *tokenStream
 	var token expressionToken
-	var parens int
+	var closers []rune
 
 	stream = newTokenStream(tokens)
 
 	for stream.hasNext() {
 
 		token = stream.next()
-		if token.Kind == clauseToken {
-			parens++
+		if token.Kind == clauseToken || token.Kind == functionToken {
+			closers = append(closers, ')')
+			continue
+		}
+		if token.Kind == nestedToken {
+			closers = append(closers, ']')
 			continue
 		}
 		if token.Kind == clauseCloseToken {
-			parens--
+			if len(closers) == 0 || closers[len(closers)-1] != token.Value {
+				return errors.New("unbalanced parenthesis")
+			}
+			closers = closers[:len(closers)-1]
 			continue
 		}
 	}
 
-	if parens != 0 {
+	if len(closers) != 0 {
 		return errors.New("unbalanced parenthesis")
 	}
 	return nil
 }
 
+/*
+	Returns the kind of token a word operator stands for in the given state,
+	or variableToken if no operator of that kind is expected.
+*/
+func wordOperatorKind(symbol string, state lexerState, options scanOptions) tokenKind {
+
+	var found bool
+
+	_, found = logicalSymbols[symbol]
+	if found && state.canTransitionTo(logicalToken) {
+		return logicalToken
+	}
+
+	_, found = comparatorSymbols[symbol]
+	if found && state.canTransitionTo(compareToken) {
+		return compareToken
+	}
+
+	_, found = prefixSymbols[symbol]
+	if found && (state.canTransitionTo(prefixToken) || options.lenient && state.isEOF) {
+		return prefixToken
+	}
+
+	return variableToken
+}
+
+/*
+	Returns true if the stream is at a `-` followed by a letter, as in the middle of `e-mail`.
+*/
+func continuesHyphenated(stream *lexerStream) bool {
+
+	return stream.position+1 < stream.length &&
+		stream.source[stream.position] == '-' &&
+		unicode.IsLetter(stream.source[stream.position+1])
+}
+
+/*
+	Returns true if the symbol just read is at the start of the input or after whitespace.
+*/
+func startsWord(stream *lexerStream) bool {
+
+	var start int
+
+	start = stream.position - 2
+	return start < 0 || unicode.IsSpace(stream.source[start])
+}
+
+/*
+	Returns true if a token of the given kind can only be the start of a new operand.
+*/
+func startsOperand(kind tokenKind) bool {
+
+	return kind != clauseCloseToken &&
+		kind != logicalToken &&
+		kind != compareToken &&
+		kind != modifierToken &&
+		kind != boostToken &&
+		kind != separatorToken
+}
+
+func isLiteral(kind tokenKind) bool {
+
+	return kind == numericToken ||
+		kind == booleanToken ||
+		kind == stringToken ||
+		kind == timeToken ||
+		kind == dateMathToken ||
+		kind == durationToken ||
+		kind == sizeToken ||
+		kind == ipToken
+}
+
+func isKnownSymbol(candidate string) bool {
+
+	_, found := operatorSymbols[candidate]
+	if found {
+		return true
+	}
+
+	_, found = prefixSymbols[candidate]
+	return found
+}
+
 func isDigit(character rune) bool {
 	return unicode.IsDigit(character)
 }
@@ -338,12 +1263,26 @@ func isNotAlphanumeric(character rune) bool {
 		!isNotQuote(character))
 }
 
+func isDateMathUnit(character rune) bool {
+
+	return strings.ContainsRune("yMwdhHms", character)
+}
+
 func isVariableName(character rune) bool {
 
 	return unicode.IsLetter(character) ||
 		unicode.IsDigit(character) ||
 		character == '_' ||
-		character == '.'
+		character == '.' ||
+		character == '@'
+}
+
+/*
+	Like isVariableName, but also accepts the `#` of search-box words such as `C#`.
+*/
+func isSearchWord(character rune) bool {
+
+	return isVariableName(character) || character == '#'
 }
 
 /*
@@ -3,13 +3,142 @@ package esqb
 import (
 	"fmt"
 	"testing"
+	"time"
 )
 
 func Test_parsing(t *testing.T) {
 	expr := `ip=="1.1.1.1"`
-	tokens, err := scanTokens(expr)
+	tokens, err := scanTokens(expr, defaultScanOptions())
 	if err != nil {
 		t.Fatal(err)
 	}
 	fmt.Println(tokens)
 }
+
+func Test_parsingArray(t *testing.T) {
+	expr := `ip in ["1.1.1.1", 2, true] && in not in []`
+	tokens, err := scanTokens(expr, defaultScanOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 7 || tokens[2].Kind != arrayToken || tokens[4].Kind != variableToken {
+		t.Fatalf("unexpected tokens %v", tokens)
+	}
+}
+
+func Test_parsingDateMath(t *testing.T) {
+	expr := `ts > now-24h && ts >= now/d && ts < now-1d/d+12h && ts < now`
+	tokens, err := scanTokens(expr, defaultScanOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []interface{}{"now-24h", "now/d", "now-1d/d+12h", "now"}
+	for i, value := range expected {
+		token := tokens[i*4+2]
+		if token.Kind != dateMathToken || token.Value != value {
+			t.Fatalf("expected date-math %v, got %v", value, token)
+		}
+	}
+	if _, err = scanTokens(`ts > now-7x`, defaultScanOptions()); err == nil {
+		t.Fatal("invalid date-math unit accepted")
+	}
+	// a bare `now` is only a date where a value is expected, otherwise it's a field
+	tokens, err = scanTokens(`now == "x" && ts in [now, now-1d] && ts < now`, defaultScanOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens[0].Kind != variableToken || tokens[6].Value.([]interface{})[0] != "now" ||
+		tokens[10].Kind != dateMathToken {
+		t.Fatalf("unexpected tokens %v", tokens)
+	}
+}
+
+func Test_parsingString(t *testing.T) {
+	expr := `a == "it's" || a == 'say "hi"' || a == "tab\there 中\"" || a == ` + "`\\d+\\.cn`"
+	tokens, err := scanTokens(expr, defaultScanOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{`it's`, `say "hi"`, "tab\there 中\"", `\d+\.cn`}
+	for i, value := range expected {
+		if tokens[i*4+2].Value != value {
+			t.Fatalf("expected string %q, got %q", value, tokens[i*4+2].Value)
+		}
+	}
+	// a backslash at the end escapes nothing, inside or outside of strings
+	for _, expr = range []string{`a == "abc\`, `a == "\u4e"`, "a == `abc", `a == abc\`, `a == 1\`, `a\`} {
+		if _, err = scanTokens(expr, defaultScanOptions()); err == nil {
+			t.Fatalf("invalid expression %s accepted", expr)
+		}
+	}
+}
+
+func Test_parsingNumber(t *testing.T) {
+	expr := `a == 80 || a == 9007199254740993 || a == 18446744073709551615 || a == 1.5 || a == 1e6 || a == -2.5E-3 || a == -80 || a == 0xff || a == -3d`
+	tokens, err := scanTokens(expr, defaultScanOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []interface{}{
+		int64(80), int64(9007199254740993), uint64(18446744073709551615), 1.5, 1e6, -2.5e-3, int64(-80), int64(255),
+		-3 * 24 * time.Hour,
+	}
+	for i, value := range expected {
+		if tokens[i*4+2].Value != value {
+			t.Fatalf("expected number %v (%T), got %v (%T)", value, value, tokens[i*4+2].Value, tokens[i*4+2].Value)
+		}
+	}
+	tokens, err = scanTokens(`a in [-1, 2] && b == 10 - 5`, defaultScanOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values := tokens[2].Value.([]interface{}); values[0] != int64(-1) || tokens[7].Kind != modifierToken {
+		t.Fatalf("unexpected tokens %v", tokens)
+	}
+}
+
+func Test_parsingQuotedField(t *testing.T) {
+	expr := `[http.response-code] >= 500 && @timestamp > now-1d && [字段 名] == "x" && [odd\]name] == 1 && [http-logs][status == 1]`
+	tokens, err := scanTokens(expr, defaultScanOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"http.response-code", "@timestamp", "字段 名", "odd]name"}
+	for i, value := range expected {
+		if tokens[i*4].Kind != variableToken || tokens[i*4].Value != value {
+			t.Fatalf("expected field %q, got %v", value, tokens[i*4])
+		}
+	}
+	if tokens[16].Kind != nestedToken || tokens[16].Value != "http-logs" {
+		t.Fatalf("expected nested http-logs, got %v", tokens[16])
+	}
+	for _, expr = range []string{"[] == 1", "[abc == 1"} {
+		if _, err = scanTokens(expr, defaultScanOptions()); err == nil {
+			t.Fatalf("%s accepted", expr)
+		}
+	}
+}
+
+func Test_parsingIP(t *testing.T) {
+	expr := `src == 10.0.0.0/8 || src in [2001:db8::1, ::1, fe80::1] || src == abc || face == :name || src == $1 || src == deadbeef`
+	tokens, err := scanTokens(expr, defaultScanOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens[2].Kind != ipToken || tokens[2].Value != "10.0.0.0/8" || len(tokens[6].Value.([]interface{})) != 3 {
+		t.Fatalf("unexpected IPs %v", tokens)
+	}
+	// hex words and placeholders are not IPs
+	expected := []expressionToken{
+		{Kind: variableToken, Value: "abc"},
+		{Kind: variableToken, Value: "face"},
+		{Kind: placeholderToken, Value: "name"},
+		{Kind: placeholderToken, Value: "1"},
+		{Kind: variableToken, Value: "deadbeef"},
+	}
+	for i, token := range []expressionToken{tokens[10], tokens[12], tokens[14], tokens[18], tokens[22]} {
+		if token != expected[i] {
+			t.Fatalf("expected %v, got %v", expected[i], token)
+		}
+	}
+}
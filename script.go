@@ -0,0 +1,92 @@
+package esqb
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// ScriptAccessor generates the SCRIPT entry of a field, which reads it in field-to-field comparisons,
+// e.g. {SCRIPT: ScriptAccessor("created_at", "doc['created_at'].value.toInstant().toEpochMilli()")}.
+// An empty accessor reads `doc['field'].value`, and documents missing the field are matched,
+// like for any other comparison. Custom accessors have to handle missing values themselves.
+func ScriptAccessor(field, accessor string) QueryGenerator {
+	script := &scriptField{field: field, accessor: accessor}
+	return func(value interface{}) elastic.Query {
+		return script
+	}
+}
+
+// scriptField is returned by the SCRIPT generators, it is never sent to elasticsearch
+type scriptField struct {
+	field    string
+	accessor string
+}
+
+func (it *scriptField) Source() (interface{}, error) {
+	return nil, fmt.Errorf("script accessor of [%s] is not a query", it.field)
+}
+
+var painlessComparators = map[Operator]string{
+	EQ:  "==",
+	NEQ: "!=",
+	GT:  ">",
+	GTE: ">=",
+	LT:  "<",
+	LTE: "<=",
+}
+
+// buildFieldComparison compiles comparisons between two fields of a document, such as `updated_at > created_at`,
+// to a painless script query
+func (it *queryBuilder) buildFieldComparison(field string, op Operator, right expressionToken) (*comparison, error) {
+	comparator, ok := painlessComparators[op]
+	if !ok {
+		return nil, fmt.Errorf("op [%s] not supported between fields", op.String())
+	}
+	other := right.Value.(string)
+
+	var guards, accessors []string
+	for _, f := range []string{field, other} {
+		script, err := it.scriptField(f)
+		if err != nil {
+			return nil, err
+		}
+		if script.accessor != "" {
+			accessors = append(accessors, script.accessor)
+			continue
+		}
+		guards = append(guards, fmt.Sprintf("doc[%s].size() == 0", painlessString(script.field)))
+		accessors = append(accessors, fmt.Sprintf("doc[%s].value", painlessString(script.field)))
+	}
+	source := fmt.Sprintf("%s %s %s", accessors[0], comparator, accessors[1])
+	if len(guards) > 0 {
+		source = strings.Join(guards, " || ") + " || " + source
+	}
+
+	it.queried[field] = true
+	it.queried[other] = true
+	query := elastic.NewScriptQuery(elastic.NewScript(source).Lang("painless"))
+	return &comparison{field: field, op: op, query: query, rightOperand: right, checksExistence: true}, nil
+}
+
+// scriptField looks up how a field is read in scripts, from the SCRIPT generator of its factory entry
+func (it *queryBuilder) scriptField(field string) (*scriptField, error) {
+	generators, ok := it.queryFactory[field]
+	if !ok {
+		return nil, fmt.Errorf("unknown field [%s]", field)
+	}
+	generator, ok := generators[SCRIPT]
+	if !ok {
+		return nil, fmt.Errorf("field [%s] can't be compared with other fields, as it has no [%s] generator", field, SCRIPT.String())
+	}
+	script, ok := generator(nil).(*scriptField)
+	if !ok {
+		return nil, fmt.Errorf("[%s] generator of field [%s] should be made by ScriptAccessor", SCRIPT.String(), field)
+	}
+	return script, nil
+}
+
+func painlessString(candidate string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(candidate) + "'"
+}
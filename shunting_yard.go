@@ -3,15 +3,70 @@ package esqb
 import (
 	"errors"
 	"fmt"
+	"strings"
 )
 
+// functionCall replaces the name of a function token in the suffix expression,
+// so the builder knows how many operands belong to the call.
+type functionCall struct {
+	name  string
+	arity int
+}
+
 func convertToSuffix(tokens []expressionToken) ([]expressionToken, error) {
 	var suffixExpression []expressionToken
 	var operators []expressionToken
-	for _, token := range tokens {
-		if token.isOperator() {
+	// argument count of every function call which is not closed yet
+	var arities []int
+	// path of every nested sub-expression which is not closed yet
+	var paths []string
+	for i, token := range tokens {
+		if token.Kind == commentToken {
+			continue
+		}
+		if token.Kind == boostToken {
+			// boosts are postfix, they apply to the comparison or group right before them,
+			// so everything binding tighter than a logical operator is popped first.
+			for len(operators) > 0 {
+				top := operators[len(operators)-1]
+				if isClauseOpener(top) {
+					break
+				}
+				topOp, err := tokenOperator(top)
+				if err != nil {
+					return nil, err
+				}
+				if topOp.precedence() < comparatorPrecedence {
+					break
+				}
+				operators = operators[:len(operators)-1]
+				suffixExpression = append(suffixExpression, top)
+			}
+			suffixExpression = append(suffixExpression, token)
+		} else if token.isOperator() {
 			if token.Kind == clauseToken {
 				operators = append(operators, token)
+			} else if token.Kind == nestedToken {
+				// nested paths are relative to the enclosing one, e.g. `vulns[refs[url == "x"]]`
+				token.Value = qualifyField(paths, token.Value.(string))
+				paths = append(paths, token.Value.(string))
+				operators = append(operators, token)
+			} else if token.Kind == functionToken {
+				operators = append(operators, token)
+				if i+1 < len(tokens) && tokens[i+1].Kind == clauseCloseToken {
+					arities = append(arities, 0)
+				} else {
+					arities = append(arities, 1)
+				}
+			} else if token.Kind == separatorToken {
+				for len(operators) > 0 && !isClauseOpener(operators[len(operators)-1]) {
+					suffixExpression = append(suffixExpression, operators[len(operators)-1])
+					operators = operators[:len(operators)-1]
+				}
+				if len(operators) == 0 || operators[len(operators)-1].Kind != functionToken {
+					return nil, errors.New("separator outside of function call")
+				}
+				arities[len(arities)-1]++
 			} else if token.Kind == clauseCloseToken {
 				clausePopped := false
 				for len(operators) > 0 {
@@ -20,6 +75,19 @@ func convertToSuffix(tokens []expressionToken) ([]expressionToken, error) {
 					if op.Kind == clauseToken {
 						clausePopped = true
 						break
+					} else if op.Kind == functionToken {
+						suffixExpression = append(suffixExpression, expressionToken{
+							Kind:  functionToken,
+							Value: functionCall{name: op.Value.(string), arity: arities[len(arities)-1]},
+						})
+						arities = arities[:len(arities)-1]
+						clausePopped = true
+						break
+					} else if op.Kind == nestedToken {
+						suffixExpression = append(suffixExpression, op)
+						paths = paths[:len(paths)-1]
+						clausePopped = true
+						break
 					} else {
 						suffixExpression = append(suffixExpression, op)
 					}
@@ -27,25 +95,26 @@ func convertToSuffix(tokens []expressionToken) ([]expressionToken, error) {
 				if !clausePopped {
 					return nil, errors.New("clauseToken mismatch")
 				}
-			} else {
-				if _, ok := token.Value.(string); !ok {
-					return nil, fmt.Errorf("Operator value is not str")
+			} else if token.Kind == prefixToken {
+				// prefix operators are right-associative and always bind to the upcoming operand,
+				// so nothing is popped before pushing them.
+				if _, err := tokenOperator(token); err != nil {
+					return nil, err
 				}
-				newOp, ok := operatorSymbols[token.Value.(string)]
-				if !ok {
-					return nil, fmt.Errorf("unknownToken op %v", token.Value)
+				operators = append(operators, token)
+			} else {
+				newOp, err := tokenOperator(token)
+				if err != nil {
+					return nil, err
 				}
 				for len(operators) > 0 {
 					top := operators[len(operators)-1]
-					if top.Kind == clauseToken {
+					if isClauseOpener(top) {
 						break
 					}
-					if _, ok = top.Value.(string); !ok {
-						return nil, fmt.Errorf("Operator value is not str")
-					}
-					topOp, ok := operatorSymbols[top.Value.(string)]
-					if !ok {
-						return nil, fmt.Errorf("unknownToken op %v", top.Value)
+					topOp, err := tokenOperator(top)
+					if err != nil {
+						return nil, err
 					}
 					if topOp.precedence() >= newOp.precedence() {
 						// pop
@@ -58,6 +127,15 @@ func convertToSuffix(tokens []expressionToken) ([]expressionToken, error) {
 				operators = append(operators, token)
 			}
 		} else {
+			if token.Kind == variableToken {
+				token.Value = qualifyField(paths, token.Value.(string))
+			} else if token.Kind == fieldGroupToken {
+				fields := make([]string, len(token.Value.([]string)))
+				for j, field := range token.Value.([]string) {
+					fields[j] = qualifyField(paths, field)
+				}
+				token.Value = fields
+			}
 			suffixExpression = append(suffixExpression, token)
 		}
 	}
@@ -65,10 +143,45 @@ func convertToSuffix(tokens []expressionToken) ([]expressionToken, error) {
 		operator := operators[len(operators)-1]
 		operators = operators[:len(operators)-1]
 
-		if operator.Kind == clauseToken {
+		if isClauseOpener(operator) {
 			return nil, errors.New("mismatched parentheses found")
 		}
 		suffixExpression = append(suffixExpression, operator)
 	}
 	return suffixExpression, nil
 }
+
+func isClauseOpener(token expressionToken) bool {
+	return token.Kind == clauseToken || token.Kind == functionToken || token.Kind == nestedToken
+}
+
+// qualifyField prefixes a field inside nested sub-expressions with the innermost nested path,
+// unless it is already qualified, so that `severity` in `vulns[severity >= 7]` is `vulns.severity`.
+func qualifyField(paths []string, field string) string {
+	if len(paths) == 0 {
+		return field
+	}
+	path := paths[len(paths)-1]
+	if strings.HasPrefix(field, path+".") {
+		return field
+	}
+	return path + "." + field
+}
+
+func tokenOperator(token expressionToken) (Operator, error) {
+	symbol, ok := token.Value.(string)
+	if !ok {
+		return value, fmt.Errorf("Operator value is not str")
+	}
+	symbols := operatorSymbols
+	if token.Kind == prefixToken {
+		symbols = prefixSymbols
+	} else if token.Kind == compareToken {
+		symbol, _ = splitFuzziness(symbol)
+	}
+	op, ok := symbols[symbol]
+	if !ok {
+		return value, fmt.Errorf("unknownToken op %v", token.Value)
+	}
+	return op, nil
+}
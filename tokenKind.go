@@ -10,18 +10,36 @@ const (
 
 	prefixToken
 	numericToken
+	durationToken
+	sizeToken
 	booleanToken
+	nullToken
 	stringToken
 	timeToken
+	dateMathToken
+	ipToken
+	ipRangeToken
+	placeholderToken
 	variableToken
+	fieldGroupToken
+	arrayToken
 
+	modifierToken
 	compareToken
 	logicalToken
 
 	clauseToken
 	clauseCloseToken
 
+	functionToken
+	separatorToken
+	nestedToken
+	boostToken
+
+	commentToken
+
 	esQueryToken
+	comparisonToken
 )
 
 /*
@@ -36,14 +54,34 @@ func (kind tokenKind) String() string {
 		return "prefixToken"
 	case numericToken:
 		return "numericToken"
+	case durationToken:
+		return "durationToken"
+	case sizeToken:
+		return "sizeToken"
 	case booleanToken:
 		return "booleanToken"
+	case nullToken:
+		return "nullToken"
 	case stringToken:
 		return "stringToken"
 	case timeToken:
 		return "timeToken"
+	case dateMathToken:
+		return "dateMathToken"
+	case ipToken:
+		return "ipToken"
+	case ipRangeToken:
+		return "ipRangeToken"
+	case placeholderToken:
+		return "placeholderToken"
 	case variableToken:
 		return "variableToken"
+	case fieldGroupToken:
+		return "fieldGroupToken"
+	case arrayToken:
+		return "arrayToken"
+	case modifierToken:
+		return "modifierToken"
 	case compareToken:
 		return "compareToken"
 	case logicalToken:
@@ -52,6 +90,16 @@ func (kind tokenKind) String() string {
 		return "clauseToken"
 	case clauseCloseToken:
 		return "clauseCloseToken"
+	case functionToken:
+		return "functionToken"
+	case separatorToken:
+		return "separatorToken"
+	case nestedToken:
+		return "nestedToken"
+	case boostToken:
+		return "boostToken"
+	case commentToken:
+		return "commentToken"
 	}
 
 	return "unknownToken"
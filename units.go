@@ -0,0 +1,74 @@
+package esqb
+
+import "time"
+
+// ByteSize is the value of a size literal such as `10MB`, in bytes
+type ByteSize int64
+
+// Size units, powers of 1024 as in elasticsearch
+const (
+	Byte     ByteSize = 1
+	Kilobyte          = 1024 * Byte
+	Megabyte          = 1024 * Kilobyte
+	Gigabyte          = 1024 * Megabyte
+	Terabyte          = 1024 * Gigabyte
+	Petabyte          = 1024 * Terabyte
+)
+
+// case-insensitive units of size literals
+var sizeUnits = map[string]ByteSize{
+	"b":  Byte,
+	"kb": Kilobyte,
+	"mb": Megabyte,
+	"gb": Gigabyte,
+	"tb": Terabyte,
+	"pb": Petabyte,
+}
+
+// WithSizeUnit makes the generators of a field receive sizes as a number of the given unit instead of bytes,
+// e.g. WithSizeUnit("memory", Kilobyte) turns `memory > 1MB` into `memory > 1024`
+func WithSizeUnit(field string, unit ByteSize) Option {
+	return func(it *queryBuilder) {
+		it.sizeUnits[field] = unit
+	}
+}
+
+// WithDurationUnit makes the generators of a field receive durations as a number of the given unit
+// instead of a time.Duration, e.g. WithDurationUnit("latency", time.Millisecond) turns `latency >= 1s` into `latency >= 1000`
+func WithDurationUnit(field string, unit time.Duration) Option {
+	return func(it *queryBuilder) {
+		it.durationUnits[field] = unit
+	}
+}
+
+// normalizeUnit converts sizes and durations, alone or in a list, to the unit configured for the field.
+// Sizes are in bytes by default, durations stay time.Duration unless a unit is configured.
+func (it *queryBuilder) normalizeUnit(field string, value interface{}) interface{} {
+	switch v := value.(type) {
+	case ByteSize:
+		unit, ok := it.sizeUnits[field]
+		if !ok {
+			unit = Byte
+		}
+		return inUnit(int64(v), int64(unit))
+	case time.Duration:
+		if unit, ok := it.durationUnits[field]; ok {
+			return inUnit(int64(v), int64(unit))
+		}
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, element := range v {
+			values[i] = it.normalizeUnit(field, element)
+		}
+		return values
+	}
+	return value
+}
+
+// inUnit is an int64 if the amount is a whole number of units, a float64 otherwise
+func inUnit(amount int64, unit int64) interface{} {
+	if amount%unit == 0 {
+		return amount / unit
+	}
+	return float64(amount) / float64(unit)
+}
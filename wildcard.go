@@ -0,0 +1,109 @@
+package esqb
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// LeadingWildcard decides how `like` patterns starting with a wildcard, such as "*.baidu.com", are handled.
+// Leading wildcards have to scan the whole term dictionary, so they are expensive on large indices.
+type LeadingWildcard int
+
+const (
+	// AllowLeadingWildcard sends the pattern as-is
+	AllowLeadingWildcard LeadingWildcard = iota
+	// RejectLeadingWildcard fails the build
+	RejectLeadingWildcard
+	// ReverseLeadingWildcard rewrites the pattern to a prefix of the reversed value, searched on a reversed field
+	ReverseLeadingWildcard
+)
+
+const defaultReversedFieldSuffix = ".reversed"
+
+// WithLeadingWildcard sets the policy for `like` patterns starting with a wildcard, AllowLeadingWildcard by default
+func WithLeadingWildcard(policy LeadingWildcard) Option {
+	return func(it *queryBuilder) {
+		it.leadingWildcard = policy
+	}
+}
+
+// WithReversedFieldSuffix sets the suffix of the sub-field holding the reversed value of a field,
+// used by ReverseLeadingWildcard. Defaults to ".reversed", e.g. "host.reversed"
+func WithReversedFieldSuffix(suffix string) Option {
+	return func(it *queryBuilder) {
+		it.reversedFieldSuffix = suffix
+	}
+}
+
+// patternQuery builds a prefix query if the only wildcard is a trailing '*', a wildcard query otherwise
+func patternQuery(field string, pattern string) elastic.Query {
+	prefix := strings.TrimSuffix(pattern, "*")
+	if prefix != pattern && !hasWildcard(prefix) {
+		return elastic.NewPrefixQuery(field, prefix)
+	}
+	return elastic.NewWildcardQuery(field, pattern)
+}
+
+// rewriteLeadingWildcard applies the leading wildcard policy to a `like` pattern.
+// Returns a nil query if the pattern should be handed to the generator unchanged.
+func (it *queryBuilder) rewriteLeadingWildcard(field string, value interface{}) (elastic.Query, error) {
+	pattern, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("operand beside [%s] should be a string pattern", LIKE.String())
+	}
+	if !strings.HasPrefix(pattern, "*") && !strings.HasPrefix(pattern, "?") {
+		return nil, nil
+	}
+	switch it.leadingWildcard {
+	case RejectLeadingWildcard:
+		return nil, fmt.Errorf("leading wildcard in pattern [%s] is not allowed", pattern)
+	case ReverseLeadingWildcard:
+		reversed := reverseString(pattern)
+		if strings.HasPrefix(reversed, "*") || strings.HasPrefix(reversed, "?") {
+			return nil, fmt.Errorf("pattern [%s] has wildcards on both ends and can't be reversed", pattern)
+		}
+		return patternQuery(field+it.reversedFieldSuffix, reversed), nil
+	}
+	return nil, nil
+}
+
+// suffixQuery builds the default query of `endswith` by the leading wildcard policy.
+// Returns a nil query if the field has its own ENDSWITH generator, or isn't known at all.
+func (it *queryBuilder) suffixQuery(field string, value interface{}) (elastic.Query, error) {
+	generators, ok := it.queryFactory[field]
+	if !ok {
+		return nil, nil
+	}
+	if _, ok = generators[ENDSWITH]; ok {
+		return nil, nil
+	}
+	suffix := fmt.Sprint(value)
+	switch it.leadingWildcard {
+	case RejectLeadingWildcard:
+		return nil, fmt.Errorf("[%s] on field [%s] needs a leading wildcard, which is not allowed", ENDSWITH.String(), field)
+	case ReverseLeadingWildcard:
+		return elastic.NewPrefixQuery(field+it.reversedFieldSuffix, reverseString(suffix)), nil
+	}
+	return elastic.NewWildcardQuery(field, "*"+escapeWildcard(suffix)), nil
+}
+
+// escapeWildcard escapes the characters having a special meaning in wildcard queries
+func escapeWildcard(literal string) string {
+	return wildcardEscaper.Replace(literal)
+}
+
+var wildcardEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`)
+
+func hasWildcard(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?")
+}
+
+func reverseString(candidate string) string {
+	runes := []rune(candidate)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}